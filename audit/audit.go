@@ -0,0 +1,152 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package audit records the authorization decisions made by the service.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EffectAllow = "ALLOW"
+	EffectDeny  = "DENY"
+)
+
+// Decision is the record of a single authorization check.
+type Decision struct {
+	Timestamp      time.Time      `json:"timestamp"`
+	RequestID      string         `json:"requestID,omitempty"`
+	PrincipalID    string         `json:"principalID"`
+	PrincipalRoles []string       `json:"principalRoles"`
+	ResourceKind   string         `json:"resourceKind"`
+	ResourceID     string         `json:"resourceID"`
+	ResourceAttr   map[string]any `json:"resourceAttr,omitempty"`
+	Action         string         `json:"action"`
+	Effect         string         `json:"effect"`
+	CallID         string         `json:"callID,omitempty"`
+	LatencyMs      float64        `json:"latencyMs"`
+	Error          string         `json:"error,omitempty"`
+}
+
+// Sink receives authorization decisions. Implementations must be safe for concurrent use.
+type Sink interface {
+	Record(Decision)
+}
+
+// MultiSink sends each decision to all of its sinks.
+type MultiSink []Sink
+
+func (ms MultiSink) Record(d Decision) {
+	for _, s := range ms {
+		s.Record(d)
+	}
+}
+
+// FileSink writes decisions to a file as JSON lines.
+type FileSink struct {
+	mu   sync.Mutex
+	f    *os.File
+	enc  *json.Encoder
+	path string
+}
+
+// NewFileSink opens the file at the given path for appending, creating it if necessary.
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log %s: %w", path, err)
+	}
+
+	return &FileSink{f: f, enc: json.NewEncoder(f), path: path}, nil
+}
+
+func (fs *FileSink) Record(d Decision) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.enc.Encode(d); err != nil {
+		// Failing to write the audit log must not fail the request, so the best we can do is shout about it.
+		fmt.Fprintf(os.Stderr, "ERROR: failed to write to audit log %s: %v\n", fs.path, err)
+	}
+}
+
+// Close closes the underlying file.
+func (fs *FileSink) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.f.Close()
+}
+
+// RingBuffer keeps the most recent decisions in memory so that they can be queried.
+type RingBuffer struct {
+	mu      sync.RWMutex
+	entries []Decision
+	next    int
+	full    bool
+}
+
+// NewRingBuffer creates a buffer that holds up to size decisions.
+func NewRingBuffer(size int) *RingBuffer {
+	return &RingBuffer{entries: make([]Decision, max(size, 1))}
+}
+
+func (rb *RingBuffer) Record(d Decision) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.entries[rb.next] = d
+	rb.next = (rb.next + 1) % len(rb.entries)
+	if rb.next == 0 {
+		rb.full = true
+	}
+}
+
+// Filter selects decisions from a RingBuffer. Empty fields match everything.
+type Filter struct {
+	PrincipalID  string
+	ResourceKind string
+	ResourceID   string
+	Effect       string
+	// Limit is the maximum number of decisions to return. Zero means no limit.
+	Limit int
+}
+
+func (f Filter) matches(d Decision) bool {
+	return (f.PrincipalID == "" || f.PrincipalID == d.PrincipalID) &&
+		(f.ResourceKind == "" || f.ResourceKind == d.ResourceKind) &&
+		(f.ResourceID == "" || f.ResourceID == d.ResourceID) &&
+		(f.Effect == "" || strings.EqualFold(f.Effect, d.Effect))
+}
+
+// Query returns the decisions that match the filter, most recent first.
+func (rb *RingBuffer) Query(f Filter) []Decision {
+	rb.mu.RLock()
+	defer rb.mu.RUnlock()
+
+	n := rb.next
+	if rb.full {
+		n = len(rb.entries)
+	}
+
+	out := []Decision{}
+	for i := 1; i <= n; i++ {
+		d := rb.entries[(rb.next-i+len(rb.entries))%len(rb.entries)]
+		if !f.matches(d) {
+			continue
+		}
+
+		out = append(out, d)
+		if f.Limit > 0 && len(out) == f.Limit {
+			break
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,127 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package db
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// APIKey is a credential that lets a client act as a user with a subset of their roles.
+// Only the hash of the key secret is stored.
+type APIKey struct {
+	ID        string     `json:"id"`
+	Username  string     `json:"username"`
+	Name      string     `json:"name"`
+	Roles     []string   `json:"roles"`
+	Hash      []byte     `json:"-"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// Expired reports whether the key has expired at the given time.
+func (k APIKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+func (k APIKey) clone() APIKey {
+	k.Roles = slices.Clone(k.Roles)
+	k.Hash = slices.Clone(k.Hash)
+	if k.ExpiresAt != nil {
+		expiresAt := *k.ExpiresAt
+		k.ExpiresAt = &expiresAt
+	}
+
+	return k
+}
+
+// sortAPIKeys orders keys by creation time, oldest first.
+func sortAPIKeys(keys []APIKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].ID < keys[j].ID
+		}
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+}
+
+// APIKeyDB is an in-memory APIKeyStore.
+type APIKeyDB struct {
+	mu   sync.RWMutex
+	keys map[string]APIKey
+}
+
+func NewAPIKeyDB() *APIKeyDB {
+	return &APIKeyDB{keys: make(map[string]APIKey)}
+}
+
+func (kdb *APIKeyDB) CreateAPIKey(ctx context.Context, key APIKey) error {
+	kdb.mu.Lock()
+	defer kdb.mu.Unlock()
+
+	if _, ok := kdb.keys[key.ID]; ok {
+		return ErrAlreadyExists
+	}
+
+	kdb.keys[key.ID] = key.clone()
+
+	return nil
+}
+
+func (kdb *APIKeyDB) GetAPIKey(ctx context.Context, id string) (APIKey, error) {
+	kdb.mu.RLock()
+	defer kdb.mu.RUnlock()
+
+	key, ok := kdb.keys[id]
+	if !ok {
+		return APIKey{}, ErrNotFound
+	}
+
+	return key.clone(), nil
+}
+
+func (kdb *APIKeyDB) ListAPIKeys(ctx context.Context, userName string) ([]APIKey, error) {
+	kdb.mu.RLock()
+	defer kdb.mu.RUnlock()
+
+	keys := []APIKey{}
+	for _, key := range kdb.keys {
+		if key.Username == userName {
+			keys = append(keys, key.clone())
+		}
+	}
+
+	sortAPIKeys(keys)
+
+	return keys, nil
+}
+
+func (kdb *APIKeyDB) DeleteAPIKey(ctx context.Context, id string) error {
+	kdb.mu.Lock()
+	defer kdb.mu.Unlock()
+
+	if _, ok := kdb.keys[id]; !ok {
+		return ErrNotFound
+	}
+
+	delete(kdb.keys, id)
+
+	return nil
+}
+
+func (kdb *APIKeyDB) DeleteUserAPIKeys(ctx context.Context, userName string) error {
+	kdb.mu.Lock()
+	defer kdb.mu.Unlock()
+
+	for id, key := range kdb.keys {
+		if key.Username == userName {
+			delete(kdb.keys, id)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package db_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cerbos/demo-rest/db"
+)
+
+func TestAPIKeyStore(t *testing.T) {
+	for name, s := range stores(t) {
+		keys := s.apiKeys
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Date(2021, 6, 1, 12, 0, 0, 123456789, time.UTC)
+			expires := now.Add(24 * time.Hour)
+
+			testKeys := []db.APIKey{
+				{ID: "k2", Username: "adam", Name: "newer", Roles: []string{"customer"}, Hash: []byte("h2"), CreatedAt: now.Add(time.Minute)},
+				{ID: "k1", Username: "adam", Name: "older", Roles: []string{"customer"}, Hash: []byte("h1"), CreatedAt: now, ExpiresAt: &expires},
+				{ID: "k3", Username: "bella", Name: "bella", Roles: []string{"employee", "manager"}, Hash: []byte("h3"), CreatedAt: now},
+			}
+			for _, key := range testKeys {
+				if err := keys.CreateAPIKey(ctx, key); err != nil {
+					t.Fatalf("Failed to create API key: %v", err)
+				}
+			}
+			if err := keys.CreateAPIKey(ctx, db.APIKey{ID: "k1", Username: "eve", CreatedAt: now}); !errors.Is(err, db.ErrAlreadyExists) {
+				t.Errorf("Expected ErrAlreadyExists, got %v", err)
+			}
+
+			got, err := keys.GetAPIKey(ctx, "k1")
+			if err != nil {
+				t.Fatalf("Failed to get API key: %v", err)
+			}
+			want := testKeys[1]
+			if got.ID != want.ID || got.Username != want.Username || got.Name != want.Name || !slices.Equal(got.Roles, want.Roles) ||
+				string(got.Hash) != string(want.Hash) || !got.CreatedAt.Equal(want.CreatedAt) || got.ExpiresAt == nil || !got.ExpiresAt.Equal(expires) {
+				t.Errorf("Expected %+v, got %+v", want, got)
+			}
+			if got, err := keys.GetAPIKey(ctx, "k2"); err != nil || got.ExpiresAt != nil {
+				t.Errorf("Expected a key without expiry, got %+v: %v", got, err)
+			}
+
+			assertKeys := func(userName string, want ...string) {
+				t.Helper()
+
+				list, err := keys.ListAPIKeys(ctx, userName)
+				if err != nil {
+					t.Fatalf("Failed to list API keys: %v", err)
+				}
+				ids := []string{}
+				for _, key := range list {
+					ids = append(ids, key.ID)
+				}
+				if !slices.Equal(ids, want) {
+					t.Errorf("Expected the keys %v of %s, got %v", want, userName, ids)
+				}
+			}
+
+			assertKeys("adam", "k1", "k2")
+			assertKeys("bella", "k3")
+			assertKeys("eve")
+
+			if err := keys.DeleteAPIKey(ctx, "k1"); err != nil {
+				t.Fatalf("Failed to delete API key: %v", err)
+			}
+			if _, err := keys.GetAPIKey(ctx, "k1"); !errors.Is(err, db.ErrNotFound) {
+				t.Errorf("Expected ErrNotFound for a deleted key, got %v", err)
+			}
+			if err := keys.DeleteAPIKey(ctx, "k1"); !errors.Is(err, db.ErrNotFound) {
+				t.Errorf("Expected ErrNotFound when deleting a deleted key, got %v", err)
+			}
+
+			if err := keys.DeleteUserAPIKeys(ctx, "adam"); err != nil {
+				t.Fatalf("Failed to delete API keys: %v", err)
+			}
+			if err := keys.DeleteUserAPIKeys(ctx, "eve"); err != nil {
+				t.Errorf("Expected deleting the keys of a user without keys to succeed, got %v", err)
+			}
+			assertKeys("adam")
+			assertKeys("bella", "k3")
+		})
+	}
+}
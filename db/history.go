@@ -0,0 +1,58 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// OrderEvent identifies the kind of change recorded in the order history.
+type OrderEvent string
+
+const (
+	EventCreated       OrderEvent = "CREATED"
+	EventUpdated       OrderEvent = "UPDATED"
+	EventStatusChanged OrderEvent = "STATUS_CHANGED"
+	EventDeleted       OrderEvent = "DELETED"
+)
+
+// HistoryEntry records a single change made to an order.
+type HistoryEntry struct {
+	Event          OrderEvent  `json:"event"`
+	PreviousStatus OrderStatus `json:"previousStatus,omitempty"`
+	NewStatus      OrderStatus `json:"newStatus,omitempty"`
+	Actor          string      `json:"actor"`
+	RequestID      string      `json:"requestID,omitempty"`
+	Timestamp      time.Time   `json:"timestamp"`
+}
+
+// Actor identifies who made a change and the request that it was made in.
+type Actor struct {
+	Username  string
+	RequestID string
+}
+
+type actorCtxKeyType struct{}
+
+var actorCtxKey = actorCtxKeyType{}
+
+// WithActor returns a context that attributes the changes made with it to the given actor.
+func WithActor(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(ctx, actorCtxKey, actor)
+}
+
+// newHistoryEntry creates a history entry attributed to the actor stored in the context.
+func newHistoryEntry(ctx context.Context, event OrderEvent, prev, next OrderStatus) HistoryEntry {
+	actor, _ := ctx.Value(actorCtxKey).(Actor)
+
+	return HistoryEntry{
+		Event:          event,
+		PreviousStatus: prev,
+		NewStatus:      next,
+		Actor:          actor.Username,
+		RequestID:      actor.RequestID,
+		Timestamp:      time.Now().UTC(),
+	}
+}
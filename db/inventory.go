@@ -4,13 +4,20 @@
 package db
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
 	"sync"
 )
 
 var (
 	ErrAlreadyExists = errors.New("already exists")
 	ErrNoStock       = errors.New("no stock")
+	// ErrInvalidQuantity is returned when a quantity is too large to be added to or removed from stock.
+	ErrInvalidQuantity = errors.New("invalid quantity")
 )
 
 type InventoryItem struct {
@@ -24,8 +31,91 @@ type InventoryRecord struct {
 	Price    uint64 `json:"price"`
 	Aisle    string `json:"aisle"`
 	Quantity int    `json:"quantity"`
+	Reserved int    `json:"reserved"`
 }
 
+// Available returns the quantity that is in stock and not reserved by an order.
+func (i InventoryRecord) Available() int {
+	return i.Quantity - i.Reserved
+}
+
+// ShortLine describes an order line that cannot be satisfied from the available stock.
+type ShortLine struct {
+	Item      string `json:"item"`
+	Requested uint   `json:"requested"`
+	Available int    `json:"available"`
+	Unknown   bool   `json:"unknown,omitempty"`
+}
+
+// StockError is returned when stock cannot be reserved for one or more order lines.
+type StockError struct {
+	Lines []ShortLine
+}
+
+func (e *StockError) Error() string {
+	items := make([]string, len(e.Lines))
+	for i, l := range e.Lines {
+		items[i] = l.Item
+	}
+
+	return fmt.Sprintf("insufficient stock for %s", strings.Join(items, ", "))
+}
+
+func (e *StockError) Is(target error) bool {
+	return target == ErrNoStock
+}
+
+// stockQuantity converts an order quantity to a stock quantity. Quantities that do not fit are rejected rather than wrapped.
+func stockQuantity(id string, qty uint) (int, error) {
+	if qty > math.MaxInt {
+		return 0, fmt.Errorf("%w: %d of %s", ErrInvalidQuantity, qty, id)
+	}
+
+	return int(qty), nil
+}
+
+// reservationDeltas returns the net change in reserved quantity for each item.
+func reservationDeltas(release, reserve map[string]uint) (map[string]int, error) {
+	deltas := make(map[string]int, len(release)+len(reserve))
+	for id, qty := range release {
+		q, err := stockQuantity(id, qty)
+		if err != nil {
+			return nil, err
+		}
+		deltas[id] -= q
+	}
+
+	// Each delta is the difference of two non-negative ints, so it cannot overflow.
+	for id, qty := range reserve {
+		q, err := stockQuantity(id, qty)
+		if err != nil {
+			return nil, err
+		}
+		deltas[id] += q
+	}
+
+	return deltas, nil
+}
+
+func sortShortLines(lines []ShortLine) {
+	sort.Slice(lines, func(a, b int) bool { return lines[a].Item < lines[b].Item })
+}
+
+// Attr returns the value of the named inventory record attribute as exposed to Cerbos policies.
+func (i InventoryRecord) Attr(name string) (any, bool) {
+	switch name {
+	case "aisle":
+		return i.Aisle, true
+	case "price":
+		return i.Price, true
+	case "quantity":
+		return i.Quantity, true
+	default:
+		return nil, false
+	}
+}
+
+// Inventory is an in-memory InventoryStore.
 type Inventory struct {
 	mu    sync.RWMutex
 	items map[string]*InventoryRecord
@@ -35,7 +125,7 @@ func NewInventory() *Inventory {
 	return &Inventory{items: make(map[string]*InventoryRecord)}
 }
 
-func (i *Inventory) Add(item InventoryItem) error {
+func (i *Inventory) Add(ctx context.Context, item InventoryItem) error {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
@@ -52,7 +142,7 @@ func (i *Inventory) Add(item InventoryItem) error {
 	return nil
 }
 
-func (i *Inventory) Update(itm InventoryItem) error {
+func (i *Inventory) Update(ctx context.Context, itm InventoryItem) error {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
@@ -67,7 +157,7 @@ func (i *Inventory) Update(itm InventoryItem) error {
 	return nil
 }
 
-func (i *Inventory) UpdateQuantity(id string, quantity int) (int, error) {
+func (i *Inventory) UpdateQuantity(ctx context.Context, id string, quantity int) (int, error) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
@@ -76,8 +166,9 @@ func (i *Inventory) UpdateQuantity(id string, quantity int) (int, error) {
 		return 0, ErrNotFound
 	}
 
+	// Stock that is reserved by orders cannot be taken away.
 	newQty := item.Quantity + quantity
-	if newQty < 0 {
+	if newQty < item.Reserved {
 		return item.Quantity, ErrNoStock
 	}
 
@@ -86,7 +177,73 @@ func (i *Inventory) UpdateQuantity(id string, quantity int) (int, error) {
 	return item.Quantity, nil
 }
 
-func (i *Inventory) Delete(id string) error {
+func (i *Inventory) ReserveStock(ctx context.Context, release, reserve map[string]uint) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	deltas, err := reservationDeltas(release, reserve)
+	if err != nil {
+		return err
+	}
+
+	var short []ShortLine
+	for id, delta := range deltas {
+		if delta <= 0 {
+			continue
+		}
+
+		item, ok := i.items[id]
+		if !ok {
+			short = append(short, ShortLine{Item: id, Requested: reserve[id], Unknown: true})
+			continue
+		}
+
+		if item.Available() < delta {
+			short = append(short, ShortLine{Item: id, Requested: reserve[id], Available: item.Available() + int(release[id])})
+		}
+	}
+
+	if len(short) > 0 {
+		sortShortLines(short)
+		return &StockError{Lines: short}
+	}
+
+	for id, delta := range deltas {
+		if item, ok := i.items[id]; ok {
+			item.Reserved = max(item.Reserved+delta, 0)
+		}
+	}
+
+	return nil
+}
+
+func (i *Inventory) PickReserved(ctx context.Context, items map[string]uint) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	quantities := make(map[string]int, len(items))
+	for id, qty := range items {
+		q, err := stockQuantity(id, qty)
+		if err != nil {
+			return err
+		}
+		quantities[id] = q
+	}
+
+	for id, qty := range quantities {
+		item, ok := i.items[id]
+		if !ok {
+			continue
+		}
+
+		item.Quantity = max(item.Quantity-qty, 0)
+		item.Reserved = max(item.Reserved-qty, 0)
+	}
+
+	return nil
+}
+
+func (i *Inventory) Delete(ctx context.Context, id string) error {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
@@ -99,7 +256,7 @@ func (i *Inventory) Delete(id string) error {
 	return nil
 }
 
-func (i *Inventory) GetItem(id string) (InventoryRecord, error) {
+func (i *Inventory) GetItem(ctx context.Context, id string) (InventoryRecord, error) {
 	i.mu.RLock()
 	defer i.mu.RUnlock()
 
@@ -110,3 +267,20 @@ func (i *Inventory) GetItem(id string) (InventoryRecord, error) {
 
 	return *item, nil
 }
+
+// List returns the inventory records that satisfy the given filter, ordered by ID.
+func (i *Inventory) List(ctx context.Context, filter func(InventoryRecord) bool) ([]InventoryRecord, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	records := make([]InventoryRecord, 0, len(i.items))
+	for _, item := range i.items {
+		if filter(*item) {
+			records = append(records, *item)
+		}
+	}
+
+	sort.Slice(records, func(a, b int) bool { return records[a].ID < records[b].ID })
+
+	return records, nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package db_test
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/cerbos/demo-rest/db"
+)
+
+func TestReserveStockRejectsOverflowingQuantities(t *testing.T) {
+	for name, s := range stores(t) {
+		inv := s.inventory
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if err := inv.Add(ctx, db.InventoryItem{ID: "eggs", Aisle: "dairy", Price: 30}); err != nil {
+				t.Fatalf("Failed to add item: %v", err)
+			}
+			if _, err := inv.UpdateQuantity(ctx, "eggs", 10); err != nil {
+				t.Fatalf("Failed to replenish item: %v", err)
+			}
+			if err := inv.ReserveStock(ctx, nil, map[string]uint{"eggs": 5}); err != nil {
+				t.Fatalf("Failed to reserve stock: %v", err)
+			}
+
+			testCases := map[string]func() error{
+				"reserve": func() error { return inv.ReserveStock(ctx, nil, map[string]uint{"eggs": math.MaxUint64}) },
+				"release": func() error { return inv.ReserveStock(ctx, map[string]uint{"eggs": math.MaxUint64}, nil) },
+				"pick":    func() error { return inv.PickReserved(ctx, map[string]uint{"eggs": math.MaxUint64}) },
+			}
+
+			for op, fn := range testCases {
+				if err := fn(); !errors.Is(err, db.ErrInvalidQuantity) {
+					t.Errorf("%s: expected ErrInvalidQuantity, got %v", op, err)
+				}
+			}
+
+			rec, err := inv.GetItem(ctx, "eggs")
+			if err != nil {
+				t.Fatalf("Failed to get item: %v", err)
+			}
+			if rec.Quantity != 10 || rec.Reserved != 5 {
+				t.Errorf("Expected quantity 10 and reserved 5, got %d and %d", rec.Quantity, rec.Reserved)
+			}
+		})
+	}
+}
+
+func TestReserveStockReportsShortLines(t *testing.T) {
+	for name, s := range stores(t) {
+		inv := s.inventory
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if err := inv.Add(ctx, db.InventoryItem{ID: "milk", Aisle: "dairy", Price: 90}); err != nil {
+				t.Fatalf("Failed to add item: %v", err)
+			}
+			if _, err := inv.UpdateQuantity(ctx, "milk", 3); err != nil {
+				t.Fatalf("Failed to replenish item: %v", err)
+			}
+
+			err := inv.ReserveStock(ctx, nil, map[string]uint{"milk": 4, "caviar": 1})
+			var stockErr *db.StockError
+			if !errors.As(err, &stockErr) {
+				t.Fatalf("Expected a StockError, got %v", err)
+			}
+
+			want := []db.ShortLine{{Item: "caviar", Requested: 1, Unknown: true}, {Item: "milk", Requested: 4, Available: 3}}
+			if len(stockErr.Lines) != len(want) || stockErr.Lines[0] != want[0] || stockErr.Lines[1] != want[1] {
+				t.Errorf("Expected %+v, got %+v", want, stockErr.Lines)
+			}
+		})
+	}
+}
+
+func TestInventoryStore(t *testing.T) {
+	for name, s := range stores(t) {
+		inv := s.inventory
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for _, item := range []db.InventoryItem{{ID: "milk", Aisle: "dairy", Price: 90}, {ID: "bread", Aisle: "bakery", Price: 150}} {
+				if err := inv.Add(ctx, item); err != nil {
+					t.Fatalf("Failed to add item: %v", err)
+				}
+			}
+			if err := inv.Add(ctx, db.InventoryItem{ID: "milk", Aisle: "bakery", Price: 1}); !errors.Is(err, db.ErrAlreadyExists) {
+				t.Errorf("Expected ErrAlreadyExists, got %v", err)
+			}
+
+			if err := inv.Update(ctx, db.InventoryItem{ID: "milk", Aisle: "chilled", Price: 95}); err != nil {
+				t.Fatalf("Failed to update item: %v", err)
+			}
+			if qty, err := inv.UpdateQuantity(ctx, "milk", 8); err != nil || qty != 8 {
+				t.Fatalf("Expected quantity 8, got %d: %v", qty, err)
+			}
+			if err := inv.ReserveStock(ctx, nil, map[string]uint{"milk": 3}); err != nil {
+				t.Fatalf("Failed to reserve stock: %v", err)
+			}
+			if qty, err := inv.UpdateQuantity(ctx, "milk", -6); !errors.Is(err, db.ErrNoStock) || qty != 8 {
+				t.Errorf("Expected ErrNoStock with quantity 8, got %d: %v", qty, err)
+			}
+			if err := inv.PickReserved(ctx, map[string]uint{"milk": 2}); err != nil {
+				t.Fatalf("Failed to pick stock: %v", err)
+			}
+
+			rec, err := inv.GetItem(ctx, "milk")
+			if err != nil {
+				t.Fatalf("Failed to get item: %v", err)
+			}
+			want := db.InventoryRecord{ID: "milk", Aisle: "chilled", Price: 95, Quantity: 6, Reserved: 1}
+			if rec != want {
+				t.Errorf("Expected %+v, got %+v", want, rec)
+			}
+
+			list, err := inv.List(ctx, func(db.InventoryRecord) bool { return true })
+			if err != nil {
+				t.Fatalf("Failed to list items: %v", err)
+			}
+			if len(list) != 2 || list[0].ID != "bread" || list[1] != want {
+				t.Errorf("Expected bread and milk, got %+v", list)
+			}
+
+			if err := inv.Delete(ctx, "bread"); err != nil {
+				t.Fatalf("Failed to delete item: %v", err)
+			}
+
+			testCases := map[string]func() error{
+				"get":             func() error { _, err := inv.GetItem(ctx, "bread"); return err },
+				"update":          func() error { return inv.Update(ctx, db.InventoryItem{ID: "bread", Aisle: "bakery"}) },
+				"update quantity": func() error { _, err := inv.UpdateQuantity(ctx, "bread", 1); return err },
+				"delete":          func() error { return inv.Delete(ctx, "bread") },
+			}
+
+			for op, fn := range testCases {
+				if err := fn(); !errors.Is(err, db.ErrNotFound) {
+					t.Errorf("%s: expected ErrNotFound, got %v", op, err)
+				}
+			}
+		})
+	}
+}
@@ -4,51 +4,137 @@
 package db
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
 	"sync"
 )
 
-var ErrNotFound = errors.New("not found")
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrAmountOverflow is returned when the amount of an order line or the total of an order does not fit in a uint64.
+	ErrAmountOverflow = errors.New("amount too large")
+)
 
 type CustomerOrder struct {
 	Items map[string]uint `json:"items"`
 }
 
+// OrderLine is an item in an order, priced at the time the order was placed.
+type OrderLine struct {
+	Item      string `json:"item"`
+	Quantity  uint   `json:"quantity"`
+	UnitPrice uint64 `json:"unitPrice"`
+	Amount    uint64 `json:"amount"`
+}
+
+// NewOrderLine creates an order line for the given quantity of an item at the given unit price.
+func NewOrderLine(item string, quantity uint, unitPrice uint64) (OrderLine, error) {
+	hi, amount := bits.Mul64(uint64(quantity), unitPrice)
+	if hi != 0 {
+		return OrderLine{}, fmt.Errorf("%w: %d of %s at %d", ErrAmountOverflow, quantity, item, unitPrice)
+	}
+
+	return OrderLine{Item: item, Quantity: quantity, UnitPrice: unitPrice, Amount: amount}, nil
+}
+
+// LinesTotal returns the sum of the amounts of the lines.
+func LinesTotal(lines []OrderLine) (uint64, error) {
+	var total, carry uint64
+	for _, l := range lines {
+		if total, carry = bits.Add64(total, l.Amount, 0); carry != 0 {
+			return 0, fmt.Errorf("%w: order total", ErrAmountOverflow)
+		}
+	}
+
+	return total, nil
+}
+
 type Order struct {
-	ID     uint64          `json:"id"`
-	Items  map[string]uint `json:"items"`
-	Owner  string          `json:"owner"`
-	Status string          `json:"status"`
+	ID       uint64          `json:"id"`
+	Items    map[string]uint `json:"items"`
+	Lines    []OrderLine     `json:"lines"`
+	Subtotal uint64          `json:"subtotal"`
+	Total    uint64          `json:"total"`
+	Owner    string          `json:"owner"`
+	Status   OrderStatus     `json:"status"`
+}
+
+// setLines replaces the lines of the order and recomputes the item quantities and totals.
+// There are no discounts or charges yet, so the total is always the same as the subtotal.
+// The order is left unchanged if the lines cannot be totalled.
+func (o *Order) setLines(lines []OrderLine) error {
+	subtotal, err := LinesTotal(lines)
+	if err != nil {
+		return err
+	}
+
+	o.Lines = lines
+	o.Items = make(map[string]uint, len(lines))
+	for _, l := range lines {
+		o.Items[l.Item] += l.Quantity
+	}
+
+	o.Subtotal = subtotal
+	o.Total = subtotal
+	return nil
+}
+
+// Attr returns the value of the named order attribute as exposed to Cerbos policies.
+func (o Order) Attr(name string) (any, bool) {
+	switch name {
+	case "items":
+		return o.Items, true
+	case "status":
+		return string(o.Status), true
+	case "owner":
+		return o.Owner, true
+	case "total":
+		return o.Total, true
+	default:
+		return nil, false
+	}
 }
 
+// OrderDB is an in-memory OrderStore.
 type OrderDB struct {
 	mu           sync.RWMutex
 	orderCounter uint64
 	orders       map[uint64]*Order
+	// history is kept separately from the orders so that it survives the deletion of an order.
+	history map[uint64][]HistoryEntry
 }
 
 func NewOrderDB() *OrderDB {
 	return &OrderDB{
-		orders: make(map[uint64]*Order),
+		orders:  make(map[uint64]*Order),
+		history: make(map[uint64][]HistoryEntry),
 	}
 }
 
-func (odb *OrderDB) Create(owner string, order CustomerOrder) uint64 {
+func (odb *OrderDB) Create(ctx context.Context, owner string, lines []OrderLine) (uint64, error) {
 	odb.mu.Lock()
 	defer odb.mu.Unlock()
 
-	odb.orderCounter++
-	odb.orders[odb.orderCounter] = &Order{
-		ID:     odb.orderCounter,
-		Items:  order.Items,
+	o := &Order{
 		Owner:  owner,
-		Status: "PENDING",
+		Status: StatusPending,
+	}
+	if err := o.setLines(lines); err != nil {
+		return 0, err
 	}
 
-	return odb.orderCounter
+	odb.orderCounter++
+	o.ID = odb.orderCounter
+	odb.orders[odb.orderCounter] = o
+	odb.history[o.ID] = append(odb.history[o.ID], newHistoryEntry(ctx, EventCreated, "", o.Status))
+
+	return odb.orderCounter, nil
 }
 
-func (odb *OrderDB) Update(orderID uint64, order CustomerOrder) error {
+func (odb *OrderDB) Update(ctx context.Context, orderID uint64, lines []OrderLine, hook OrderHook) error {
 	odb.mu.Lock()
 	defer odb.mu.Unlock()
 
@@ -57,26 +143,41 @@ func (odb *OrderDB) Update(orderID uint64, order CustomerOrder) error {
 		return ErrNotFound
 	}
 
-	o.Items = order.Items
+	updated := *o
+	if err := updated.setLines(lines); err != nil {
+		return err
+	}
+
+	if err := runHook(ctx, hook, *o); err != nil {
+		return err
+	}
+
+	*o = updated
+	odb.history[orderID] = append(odb.history[orderID], newHistoryEntry(ctx, EventUpdated, o.Status, o.Status))
 
 	return nil
 }
 
-func (odb *OrderDB) Delete(orderID uint64) error {
+func (odb *OrderDB) Delete(ctx context.Context, orderID uint64, hook OrderHook) error {
 	odb.mu.Lock()
 	defer odb.mu.Unlock()
 
-	_, ok := odb.orders[orderID]
+	o, ok := odb.orders[orderID]
 	if !ok {
 		return ErrNotFound
 	}
 
+	if err := runHook(ctx, hook, *o); err != nil {
+		return err
+	}
+
 	delete(odb.orders, orderID)
+	odb.history[orderID] = append(odb.history[orderID], newHistoryEntry(ctx, EventDeleted, o.Status, ""))
 
 	return nil
 }
 
-func (odb *OrderDB) Get(orderID uint64) (Order, error) {
+func (odb *OrderDB) Get(ctx context.Context, orderID uint64) (Order, error) {
 	odb.mu.RLock()
 	defer odb.mu.RUnlock()
 
@@ -88,7 +189,7 @@ func (odb *OrderDB) Get(orderID uint64) (Order, error) {
 	return *o, nil
 }
 
-func (odb *OrderDB) SetStatus(orderID uint64, status string) error {
+func (odb *OrderDB) SetStatus(ctx context.Context, orderID uint64, status OrderStatus, hook OrderHook) error {
 	odb.mu.Lock()
 	defer odb.mu.Unlock()
 
@@ -97,7 +198,55 @@ func (odb *OrderDB) SetStatus(orderID uint64, status string) error {
 		return ErrNotFound
 	}
 
+	if err := checkTransition(o.Status, status); err != nil {
+		return err
+	}
+
+	if err := runHook(ctx, hook, *o); err != nil {
+		return err
+	}
+
+	odb.history[orderID] = append(odb.history[orderID], newHistoryEntry(ctx, EventStatusChanged, o.Status, status))
 	o.Status = status
 
 	return nil
 }
+
+// runHook calls the hook, if there is one, with a copy of the order.
+// The hook runs while the store is locked, so it must not call the OrderDB.
+func runHook(ctx context.Context, hook OrderHook, o Order) error {
+	if hook == nil {
+		return nil
+	}
+
+	return hook(ctx, o)
+}
+
+func (odb *OrderDB) History(ctx context.Context, orderID uint64) ([]HistoryEntry, error) {
+	odb.mu.RLock()
+	defer odb.mu.RUnlock()
+
+	h, ok := odb.history[orderID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return append([]HistoryEntry{}, h...), nil
+}
+
+// List returns the orders that satisfy the given filter, ordered by ID.
+func (odb *OrderDB) List(ctx context.Context, filter func(Order) bool) ([]Order, error) {
+	odb.mu.RLock()
+	defer odb.mu.RUnlock()
+
+	orders := make([]Order, 0, len(odb.orders))
+	for _, o := range odb.orders {
+		if filter(*o) {
+			orders = append(orders, *o)
+		}
+	}
+
+	sort.Slice(orders, func(i, j int) bool { return orders[i].ID < orders[j].ID })
+
+	return orders, nil
+}
@@ -0,0 +1,353 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package db_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/cerbos/demo-rest/db"
+)
+
+func TestNewOrderLineRejectsOverflowingAmounts(t *testing.T) {
+	line, err := db.NewOrderLine("eggs", 24, 30)
+	if err != nil {
+		t.Fatalf("Failed to create order line: %v", err)
+	}
+	if line.Amount != 720 {
+		t.Errorf("Expected amount 720, got %d", line.Amount)
+	}
+
+	if _, err := db.NewOrderLine("caviar", 2, math.MaxUint64/2+1); !errors.Is(err, db.ErrAmountOverflow) {
+		t.Errorf("Expected ErrAmountOverflow, got %v", err)
+	}
+}
+
+func TestCreateRejectsOverflowingTotals(t *testing.T) {
+	lines := []db.OrderLine{
+		{Item: "caviar", Quantity: 1, UnitPrice: math.MaxUint64, Amount: math.MaxUint64},
+		{Item: "eggs", Quantity: 1, UnitPrice: 30, Amount: 30},
+	}
+
+	for name, s := range stores(t) {
+		orders := s.orders
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if _, err := orders.Create(ctx, "adam", lines); !errors.Is(err, db.ErrAmountOverflow) {
+				t.Fatalf("Expected ErrAmountOverflow, got %v", err)
+			}
+
+			id, err := orders.Create(ctx, "adam", lines[1:])
+			if err != nil {
+				t.Fatalf("Failed to create order: %v", err)
+			}
+			if err := orders.Update(ctx, id, lines, nil); !errors.Is(err, db.ErrAmountOverflow) {
+				t.Fatalf("Expected ErrAmountOverflow, got %v", err)
+			}
+
+			o, err := orders.Get(ctx, id)
+			if err != nil {
+				t.Fatalf("Failed to get order: %v", err)
+			}
+			if o.Total != 30 || len(o.Lines) != 1 {
+				t.Errorf("Expected the order to be unchanged, got %+v", o)
+			}
+		})
+	}
+}
+
+func TestSetStatusHook(t *testing.T) {
+	errHook := errors.New("hook failed")
+	for name, tc := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if err := tc.inventory.Add(ctx, db.InventoryItem{ID: "eggs", Aisle: "dairy", Price: 30}); err != nil {
+				t.Fatalf("Failed to add item: %v", err)
+			}
+			if _, err := tc.inventory.UpdateQuantity(ctx, "eggs", 10); err != nil {
+				t.Fatalf("Failed to replenish item: %v", err)
+			}
+			if err := tc.inventory.ReserveStock(ctx, nil, map[string]uint{"eggs": 6}); err != nil {
+				t.Fatalf("Failed to reserve stock: %v", err)
+			}
+
+			line, err := db.NewOrderLine("eggs", 6, 30)
+			if err != nil {
+				t.Fatalf("Failed to create order line: %v", err)
+			}
+			id, err := tc.orders.Create(ctx, "adam", []db.OrderLine{line})
+			if err != nil {
+				t.Fatalf("Failed to create order: %v", err)
+			}
+
+			release := func(ctx context.Context, current db.Order) error {
+				return tc.inventory.ReserveStock(ctx, current.Items, nil)
+			}
+
+			assertState := func(status db.OrderStatus, reserved int) {
+				t.Helper()
+
+				o, err := tc.orders.Get(ctx, id)
+				if err != nil {
+					t.Fatalf("Failed to get order: %v", err)
+				}
+				rec, err := tc.inventory.GetItem(ctx, "eggs")
+				if err != nil {
+					t.Fatalf("Failed to get item: %v", err)
+				}
+				if o.Status != status || rec.Reserved != reserved {
+					t.Errorf("Expected status %s and %d reserved, got %s and %d", status, reserved, o.Status, rec.Reserved)
+				}
+			}
+
+			hookCalled := false
+			err = tc.orders.SetStatus(ctx, id, db.StatusDelivered, func(context.Context, db.Order) error {
+				hookCalled = true
+				return nil
+			})
+			if !errors.Is(err, db.ErrInvalidTransition) || hookCalled {
+				t.Fatalf("Expected ErrInvalidTransition without calling the hook, got %v", err)
+			}
+
+			err = tc.orders.SetStatus(ctx, id, db.StatusCancelled, func(ctx context.Context, current db.Order) error {
+				if err := release(ctx, current); err != nil {
+					return err
+				}
+				return errHook
+			})
+			if !errors.Is(err, errHook) {
+				t.Fatalf("Expected the hook error, got %v", err)
+			}
+			if tc.atomic {
+				assertState(db.StatusPending, 6)
+			} else {
+				assertState(db.StatusPending, 0)
+				if err := tc.inventory.ReserveStock(ctx, nil, map[string]uint{"eggs": 6}); err != nil {
+					t.Fatalf("Failed to reserve stock: %v", err)
+				}
+			}
+
+			if err := tc.orders.SetStatus(ctx, id, db.StatusCancelled, release); err != nil {
+				t.Fatalf("Failed to cancel order: %v", err)
+			}
+			assertState(db.StatusCancelled, 0)
+		})
+	}
+}
+
+func TestSQLiteHistoryOfOrdersWithoutHistory(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.db")
+	orders := openSQLite(t, path).Orders()
+	id, err := orders.Create(ctx, "adam", nil)
+	if err != nil {
+		t.Fatalf("Failed to create order: %v", err)
+	}
+
+	// Remove the history to make the order look like one created before the history table was added.
+	raw, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer raw.Close()
+	if _, err := raw.ExecContext(ctx, `DELETE FROM order_history`); err != nil {
+		t.Fatalf("Failed to delete history: %v", err)
+	}
+
+	history, err := orders.History(ctx, id)
+	if err != nil {
+		t.Fatalf("Failed to get history: %v", err)
+	}
+	if len(history) != 0 {
+		t.Errorf("Expected no history, got %+v", history)
+	}
+
+	if _, err := orders.History(ctx, id+1); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an unknown order, got %v", err)
+	}
+}
+
+func TestOrderStore(t *testing.T) {
+	for name, s := range stores(t) {
+		orders := s.orders
+		t.Run(name, func(t *testing.T) {
+			ctx := db.WithActor(context.Background(), db.Actor{Username: "bella", RequestID: "req-1"})
+			eggs, err := db.NewOrderLine("eggs", 6, 30)
+			if err != nil {
+				t.Fatalf("Failed to create order line: %v", err)
+			}
+			milk, err := db.NewOrderLine("milk", 2, 90)
+			if err != nil {
+				t.Fatalf("Failed to create order line: %v", err)
+			}
+
+			first, err := orders.Create(ctx, "adam", []db.OrderLine{eggs})
+			if err != nil {
+				t.Fatalf("Failed to create order: %v", err)
+			}
+			second, err := orders.Create(ctx, "eve", []db.OrderLine{eggs, milk})
+			if err != nil {
+				t.Fatalf("Failed to create order: %v", err)
+			}
+			if second <= first {
+				t.Errorf("Expected increasing order IDs, got %d and %d", first, second)
+			}
+
+			o, err := orders.Get(ctx, second)
+			if err != nil {
+				t.Fatalf("Failed to get order: %v", err)
+			}
+			if o.ID != second || o.Owner != "eve" || o.Status != db.StatusPending || o.Total != 360 || o.Items["eggs"] != 6 || o.Items["milk"] != 2 {
+				t.Errorf("Unexpected order %+v", o)
+			}
+
+			if err := orders.Update(ctx, first, []db.OrderLine{milk}, nil); err != nil {
+				t.Fatalf("Failed to update order: %v", err)
+			}
+			if err := orders.SetStatus(ctx, first, db.StatusCancelled, nil); err != nil {
+				t.Fatalf("Failed to cancel order: %v", err)
+			}
+			if o, err = orders.Get(ctx, first); err != nil {
+				t.Fatalf("Failed to get order: %v", err)
+			}
+			if o.Status != db.StatusCancelled || o.Total != 180 || len(o.Items) != 1 || o.Items["milk"] != 2 {
+				t.Errorf("Unexpected order %+v", o)
+			}
+
+			list, err := orders.List(ctx, func(o db.Order) bool { return o.Owner == "eve" })
+			if err != nil {
+				t.Fatalf("Failed to list orders: %v", err)
+			}
+			if len(list) != 1 || list[0].ID != second {
+				t.Errorf("Expected the order of eve, got %+v", list)
+			}
+
+			if err := orders.Delete(ctx, first, nil); err != nil {
+				t.Fatalf("Failed to delete order: %v", err)
+			}
+			if _, err := orders.Get(ctx, first); !errors.Is(err, db.ErrNotFound) {
+				t.Errorf("Expected ErrNotFound for a deleted order, got %v", err)
+			}
+
+			history, err := orders.History(ctx, first)
+			if err != nil {
+				t.Fatalf("Failed to get history: %v", err)
+			}
+			want := []db.HistoryEntry{
+				{Event: db.EventCreated, NewStatus: db.StatusPending},
+				{Event: db.EventUpdated, PreviousStatus: db.StatusPending, NewStatus: db.StatusPending},
+				{Event: db.EventStatusChanged, PreviousStatus: db.StatusPending, NewStatus: db.StatusCancelled},
+				{Event: db.EventDeleted, PreviousStatus: db.StatusCancelled},
+			}
+			if len(history) != len(want) {
+				t.Fatalf("Expected %d history entries, got %+v", len(want), history)
+			}
+			for i, h := range history {
+				if h.Event != want[i].Event || h.PreviousStatus != want[i].PreviousStatus || h.NewStatus != want[i].NewStatus {
+					t.Errorf("Expected entry %d to be %+v, got %+v", i, want[i], h)
+				}
+				if h.Actor != "bella" || h.RequestID != "req-1" || h.Timestamp.IsZero() {
+					t.Errorf("Expected entry %d to be attributed to bella in req-1, got %+v", i, h)
+				}
+			}
+
+			unknown := second + 1
+			testCases := map[string]func() error{
+				"get":        func() error { _, err := orders.Get(ctx, unknown); return err },
+				"update":     func() error { return orders.Update(ctx, unknown, nil, nil) },
+				"set status": func() error { return orders.SetStatus(ctx, unknown, db.StatusCancelled, nil) },
+				"delete":     func() error { return orders.Delete(ctx, unknown, nil) },
+				"history":    func() error { _, err := orders.History(ctx, unknown); return err },
+			}
+
+			for op, fn := range testCases {
+				if err := fn(); !errors.Is(err, db.ErrNotFound) {
+					t.Errorf("%s: expected ErrNotFound, got %v", op, err)
+				}
+			}
+		})
+	}
+}
+
+func TestOrderHookErrors(t *testing.T) {
+	errHook := errors.New("hook failed")
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if err := s.inventory.Add(ctx, db.InventoryItem{ID: "eggs", Aisle: "dairy", Price: 30}); err != nil {
+				t.Fatalf("Failed to add item: %v", err)
+			}
+			if _, err := s.inventory.UpdateQuantity(ctx, "eggs", 10); err != nil {
+				t.Fatalf("Failed to replenish item: %v", err)
+			}
+
+			line, err := db.NewOrderLine("eggs", 2, 30)
+			if err != nil {
+				t.Fatalf("Failed to create order line: %v", err)
+			}
+			id, err := s.orders.Create(ctx, "adam", []db.OrderLine{line})
+			if err != nil {
+				t.Fatalf("Failed to create order: %v", err)
+			}
+
+			// The hook reserves stock in the same transaction as the order change before failing.
+			failingHook := func(ctx context.Context, _ db.Order) error {
+				if err := s.inventory.ReserveStock(ctx, nil, map[string]uint{"eggs": 4}); err != nil {
+					return err
+				}
+				return errHook
+			}
+
+			bigger, err := db.NewOrderLine("eggs", 4, 30)
+			if err != nil {
+				t.Fatalf("Failed to create order line: %v", err)
+			}
+
+			testCases := map[string]func() error{
+				"update": func() error { return s.orders.Update(ctx, id, []db.OrderLine{bigger}, failingHook) },
+				"delete": func() error { return s.orders.Delete(ctx, id, failingHook) },
+			}
+
+			for op, fn := range testCases {
+				if err := fn(); !errors.Is(err, errHook) {
+					t.Fatalf("%s: expected the hook error, got %v", op, err)
+				}
+
+				o, err := s.orders.Get(ctx, id)
+				if err != nil {
+					t.Fatalf("%s: failed to get order: %v", op, err)
+				}
+				if o.Items["eggs"] != 2 {
+					t.Errorf("%s: expected the order to be unchanged, got %+v", op, o)
+				}
+
+				history, err := s.orders.History(ctx, id)
+				if err != nil {
+					t.Fatalf("%s: failed to get history: %v", op, err)
+				}
+				if len(history) != 1 {
+					t.Errorf("%s: expected only the creation in the history, got %+v", op, history)
+				}
+
+				rec, err := s.inventory.GetItem(ctx, "eggs")
+				if err != nil {
+					t.Fatalf("%s: failed to get item: %v", op, err)
+				}
+				if s.atomic && rec.Reserved != 0 {
+					t.Errorf("%s: expected the reservation to be rolled back, got %d reserved", op, rec.Reserved)
+				}
+				if !s.atomic {
+					// The in-memory stores cannot roll back the changes made by the hook.
+					if err := s.inventory.ReserveStock(ctx, map[string]uint{"eggs": 4}, nil); err != nil {
+						t.Fatalf("%s: failed to release stock: %v", op, err)
+					}
+				}
+			}
+		})
+	}
+}
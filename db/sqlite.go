@@ -0,0 +1,860 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite" // Registers the sqlite driver.
+)
+
+// migrations are applied in order to bring the schema up to date.
+// The index of the last applied migration is stored in the user_version pragma,
+// so existing entries must never be changed or reordered -- only appended to.
+var migrations = []func(context.Context, *sql.Tx) error{
+	execMigration(`
+CREATE TABLE orders (
+	id     INTEGER PRIMARY KEY AUTOINCREMENT,
+	owner  TEXT NOT NULL,
+	status TEXT NOT NULL,
+	items  TEXT NOT NULL
+);
+
+CREATE TABLE inventory (
+	id       TEXT PRIMARY KEY,
+	aisle    TEXT NOT NULL,
+	price    INTEGER NOT NULL,
+	quantity INTEGER NOT NULL DEFAULT 0 CHECK (quantity >= 0)
+);
+
+CREATE TABLE users (
+	username      TEXT PRIMARY KEY,
+	password_hash BLOB NOT NULL,
+	roles         TEXT NOT NULL,
+	aisles        TEXT NOT NULL
+);`),
+	seedUsers,
+	execMigration(`ALTER TABLE users ADD COLUMN disabled INTEGER NOT NULL DEFAULT 0`),
+	execMigration(`ALTER TABLE inventory ADD COLUMN reserved INTEGER NOT NULL DEFAULT 0`),
+	execMigration(`ALTER TABLE orders ADD COLUMN lines TEXT NOT NULL DEFAULT '[]'`),
+	execMigration(`
+CREATE TABLE order_history (
+	seq             INTEGER PRIMARY KEY AUTOINCREMENT,
+	order_id        INTEGER NOT NULL,
+	event           TEXT NOT NULL,
+	previous_status TEXT NOT NULL,
+	new_status      TEXT NOT NULL,
+	actor           TEXT NOT NULL,
+	request_id      TEXT NOT NULL,
+	timestamp       TEXT NOT NULL
+);
+
+CREATE INDEX order_history_order_id ON order_history (order_id);`),
+	execMigration(`
+CREATE TABLE api_keys (
+	id         TEXT PRIMARY KEY,
+	username   TEXT NOT NULL,
+	name       TEXT NOT NULL,
+	roles      TEXT NOT NULL,
+	hash       BLOB NOT NULL,
+	created_at TEXT NOT NULL,
+	expires_at TEXT
+);
+
+CREATE INDEX api_keys_username ON api_keys (username);`),
+}
+
+func execMigration(stmt string) func(context.Context, *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, stmt)
+		return err
+	}
+}
+
+// seedUsers copies the built-in demo users into the database.
+func seedUsers(ctx context.Context, tx *sql.Tx) error {
+	for name, rec := range users {
+		if err := insertUser(ctx, tx, name, rec); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func insertUser(ctx context.Context, tx *sql.Tx, name string, rec *UserRecord) error {
+	roles, aisles, err := marshalUserLists(rec)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO users (username, password_hash, roles, aisles) VALUES (?, ?, ?, ?)`,
+		name, rec.PasswordHash, roles, aisles)
+	return err
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// SQLite provides persistent order, inventory, user and API key stores backed by a SQLite database.
+type SQLite struct {
+	db *sql.DB
+}
+
+// OpenSQLite opens the SQLite database at the given path and applies any pending schema migrations.
+func OpenSQLite(ctx context.Context, path string) (*SQLite, error) {
+	sdb, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)", path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	// SQLite only allows a single writer. Serialising access through one connection
+	// avoids "database is locked" errors without the need for retries.
+	sdb.SetMaxOpenConns(1)
+
+	if err := migrate(ctx, sdb); err != nil {
+		sdb.Close()
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	return &SQLite{db: sdb}, nil
+}
+
+func migrate(ctx context.Context, sdb *sql.DB) error {
+	var version int
+	if err := sdb.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		err := withTx(ctx, sdb, func(tx *sql.Tx) error {
+			if err := migrations[i](ctx, tx); err != nil {
+				return err
+			}
+
+			_, err := tx.ExecContext(ctx, fmt.Sprintf(`PRAGMA user_version = %d`, i+1))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d failed: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// txKey is the context key of the transaction that the stores join when they are called from an OrderHook.
+type txKey struct{}
+
+type sharedTx struct {
+	db *sql.DB
+	tx *sql.Tx
+}
+
+// withTx runs fn in a transaction. If the context carries a transaction on the same database, fn runs in it
+// and the transaction is left for its owner to commit or roll back.
+func withTx(ctx context.Context, sdb *sql.DB, fn func(*sql.Tx) error) error {
+	if shared, ok := ctx.Value(txKey{}).(sharedTx); ok && shared.db == sdb {
+		return fn(shared.tx)
+	}
+
+	tx, err := sdb.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Close closes the underlying database.
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
+
+// Orders returns an OrderStore backed by the database.
+func (s *SQLite) Orders() *SQLiteOrderDB {
+	return &SQLiteOrderDB{db: s.db}
+}
+
+// Inventory returns an InventoryStore backed by the database.
+func (s *SQLite) Inventory() *SQLiteInventory {
+	return &SQLiteInventory{db: s.db}
+}
+
+// Users returns a UserStore backed by the database.
+func (s *SQLite) Users() *SQLiteUserDB {
+	return &SQLiteUserDB{db: s.db}
+}
+
+// APIKeys returns an APIKeyStore backed by the database.
+func (s *SQLite) APIKeys() *SQLiteAPIKeyDB {
+	return &SQLiteAPIKeyDB{db: s.db}
+}
+
+// SQLiteOrderDB is an OrderStore backed by SQLite.
+// Order IDs are allocated by an AUTOINCREMENT column so that, like the in-memory counter, they are never reused.
+type SQLiteOrderDB struct {
+	db *sql.DB
+}
+
+func (odb *SQLiteOrderDB) Create(ctx context.Context, owner string, lines []OrderLine) (uint64, error) {
+	items, linesJSON, err := marshalOrderLines(lines)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int64
+	err = withTx(ctx, odb.db, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `INSERT INTO orders (owner, status, items, lines) VALUES (?, ?, ?, ?)`, owner, StatusPending, items, linesJSON)
+		if err != nil {
+			return err
+		}
+
+		if id, err = res.LastInsertId(); err != nil {
+			return err
+		}
+
+		return appendHistory(ctx, tx, uint64(id), newHistoryEntry(ctx, EventCreated, "", StatusPending))
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(id), nil
+}
+
+func (odb *SQLiteOrderDB) Update(ctx context.Context, orderID uint64, lines []OrderLine, hook OrderHook) error {
+	items, linesJSON, err := marshalOrderLines(lines)
+	if err != nil {
+		return err
+	}
+
+	return withTx(ctx, odb.db, func(tx *sql.Tx) error {
+		current, err := getOrder(ctx, tx, orderID)
+		if err != nil {
+			return err
+		}
+
+		if err := odb.runHook(ctx, tx, hook, current); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `UPDATE orders SET items = ?, lines = ? WHERE id = ?`, items, linesJSON, orderID); err != nil {
+			return err
+		}
+
+		return appendHistory(ctx, tx, orderID, newHistoryEntry(ctx, EventUpdated, current.Status, current.Status))
+	})
+}
+
+func (odb *SQLiteOrderDB) Delete(ctx context.Context, orderID uint64, hook OrderHook) error {
+	return withTx(ctx, odb.db, func(tx *sql.Tx) error {
+		current, err := getOrder(ctx, tx, orderID)
+		if err != nil {
+			return err
+		}
+
+		if err := odb.runHook(ctx, tx, hook, current); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `DELETE FROM orders WHERE id = ?`, orderID); err != nil {
+			return err
+		}
+
+		return appendHistory(ctx, tx, orderID, newHistoryEntry(ctx, EventDeleted, current.Status, ""))
+	})
+}
+
+func (odb *SQLiteOrderDB) Get(ctx context.Context, orderID uint64) (Order, error) {
+	return getOrder(ctx, odb.db, orderID)
+}
+
+func (odb *SQLiteOrderDB) SetStatus(ctx context.Context, orderID uint64, status OrderStatus, hook OrderHook) error {
+	return withTx(ctx, odb.db, func(tx *sql.Tx) error {
+		current, err := getOrder(ctx, tx, orderID)
+		if err != nil {
+			return err
+		}
+
+		if err := checkTransition(current.Status, status); err != nil {
+			return err
+		}
+
+		if err := odb.runHook(ctx, tx, hook, current); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = ? WHERE id = ?`, status, orderID); err != nil {
+			return err
+		}
+
+		return appendHistory(ctx, tx, orderID, newHistoryEntry(ctx, EventStatusChanged, current.Status, status))
+	})
+}
+
+// runHook calls the hook, if there is one, with a context that makes the stores join the transaction.
+func (odb *SQLiteOrderDB) runHook(ctx context.Context, tx *sql.Tx, hook OrderHook, current Order) error {
+	if hook == nil {
+		return nil
+	}
+
+	return hook(context.WithValue(ctx, txKey{}, sharedTx{db: odb.db, tx: tx}), current)
+}
+
+func getOrder(ctx context.Context, q rowQueryer, orderID uint64) (Order, error) {
+	o, err := scanOrder(q.QueryRowContext(ctx, `SELECT `+orderColumns+` FROM orders WHERE id = ?`, orderID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Order{}, ErrNotFound
+	}
+
+	return o, err
+}
+
+func (odb *SQLiteOrderDB) History(ctx context.Context, orderID uint64) ([]HistoryEntry, error) {
+	rows, err := odb.db.QueryContext(ctx, `SELECT event, previous_status, new_status, actor, request_id, timestamp
+FROM order_history WHERE order_id = ? ORDER BY seq`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []HistoryEntry
+	for rows.Next() {
+		var h HistoryEntry
+		var ts string
+		if err := rows.Scan(&h.Event, &h.PreviousStatus, &h.NewStatus, &h.Actor, &h.RequestID, &ts); err != nil {
+			return nil, err
+		}
+
+		if h.Timestamp, err = time.Parse(time.RFC3339Nano, ts); err != nil {
+			return nil, fmt.Errorf("invalid timestamp in history of order %d: %w", orderID, err)
+		}
+
+		history = append(history, h)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(history) == 0 {
+		// Orders created before the history table was added have no history, but they still exist.
+		if _, err := getOrder(ctx, odb.db, orderID); err != nil {
+			return nil, err
+		}
+		return []HistoryEntry{}, nil
+	}
+
+	return history, nil
+}
+
+func appendHistory(ctx context.Context, tx *sql.Tx, orderID uint64, h HistoryEntry) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO order_history (order_id, event, previous_status, new_status, actor, request_id, timestamp)
+VALUES (?, ?, ?, ?, ?, ?, ?)`, orderID, h.Event, h.PreviousStatus, h.NewStatus, h.Actor, h.RequestID, h.Timestamp.Format(time.RFC3339Nano))
+	return err
+}
+
+func (odb *SQLiteOrderDB) List(ctx context.Context, filter func(Order) bool) ([]Order, error) {
+	rows, err := odb.db.QueryContext(ctx, `SELECT `+orderColumns+` FROM orders ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []Order{}
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		if filter(o) {
+			orders = append(orders, o)
+		}
+	}
+
+	return orders, rows.Err()
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+const orderColumns = `id, owner, status, items, lines`
+
+func scanOrder(row scanner) (Order, error) {
+	var o Order
+	var items, lines []byte
+	if err := row.Scan(&o.ID, &o.Owner, &o.Status, &items, &lines); err != nil {
+		return Order{}, err
+	}
+
+	if err := json.Unmarshal(items, &o.Items); err != nil {
+		return Order{}, fmt.Errorf("invalid items for order %d: %w", o.ID, err)
+	}
+
+	var orderLines []OrderLine
+	if err := json.Unmarshal(lines, &orderLines); err != nil {
+		return Order{}, fmt.Errorf("invalid lines for order %d: %w", o.ID, err)
+	}
+
+	// Orders created before pricing was introduced only have items.
+	if len(orderLines) > 0 {
+		if err := o.setLines(orderLines); err != nil {
+			return Order{}, fmt.Errorf("invalid lines for order %d: %w", o.ID, err)
+		}
+	}
+
+	return o, nil
+}
+
+func marshalOrderLines(lines []OrderLine) (items, linesJSON []byte, err error) {
+	var o Order
+	if err := o.setLines(lines); err != nil {
+		return nil, nil, err
+	}
+
+	if items, err = json.Marshal(o.Items); err != nil {
+		return nil, nil, err
+	}
+
+	if linesJSON, err = json.Marshal(o.Lines); err != nil {
+		return nil, nil, err
+	}
+
+	return items, linesJSON, nil
+}
+
+// SQLiteInventory is an InventoryStore backed by SQLite.
+type SQLiteInventory struct {
+	db *sql.DB
+}
+
+func (i *SQLiteInventory) Add(ctx context.Context, item InventoryItem) error {
+	return withTx(ctx, i.db, func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM inventory WHERE id = ?)`, item.ID).Scan(&exists); err != nil {
+			return err
+		}
+
+		if exists {
+			return ErrAlreadyExists
+		}
+
+		_, err := tx.ExecContext(ctx, `INSERT INTO inventory (id, aisle, price) VALUES (?, ?, ?)`, item.ID, item.Aisle, item.Price)
+		return err
+	})
+}
+
+func (i *SQLiteInventory) Update(ctx context.Context, item InventoryItem) error {
+	res, err := i.db.ExecContext(ctx, `UPDATE inventory SET aisle = ?, price = ? WHERE id = ?`, item.Aisle, item.Price, item.ID)
+	if err != nil {
+		return err
+	}
+
+	return checkAffected(res)
+}
+
+func (i *SQLiteInventory) UpdateQuantity(ctx context.Context, id string, quantity int) (int, error) {
+	var newQty int
+	err := withTx(ctx, i.db, func(tx *sql.Tx) error {
+		rec, err := getInventoryRecord(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+
+		// Stock that is reserved by orders cannot be taken away.
+		newQty = rec.Quantity + quantity
+		if newQty < rec.Reserved {
+			newQty = rec.Quantity
+			return ErrNoStock
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE inventory SET quantity = ? WHERE id = ?`, newQty, id)
+		return err
+	})
+
+	return newQty, err
+}
+
+func (i *SQLiteInventory) ReserveStock(ctx context.Context, release, reserve map[string]uint) error {
+	return withTx(ctx, i.db, func(tx *sql.Tx) error {
+		deltas, err := reservationDeltas(release, reserve)
+		if err != nil {
+			return err
+		}
+		records := make(map[string]InventoryRecord, len(deltas))
+
+		var short []ShortLine
+		for id, delta := range deltas {
+			rec, err := getInventoryRecord(ctx, tx, id)
+			if err != nil {
+				if !errors.Is(err, ErrNotFound) {
+					return err
+				}
+
+				if delta > 0 {
+					short = append(short, ShortLine{Item: id, Requested: reserve[id], Unknown: true})
+				}
+				continue
+			}
+
+			if delta > 0 && rec.Available() < delta {
+				short = append(short, ShortLine{Item: id, Requested: reserve[id], Available: rec.Available() + int(release[id])})
+			}
+			records[id] = rec
+		}
+
+		if len(short) > 0 {
+			sortShortLines(short)
+			return &StockError{Lines: short}
+		}
+
+		for id, rec := range records {
+			if _, err := tx.ExecContext(ctx, `UPDATE inventory SET reserved = ? WHERE id = ?`, max(rec.Reserved+deltas[id], 0), id); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (i *SQLiteInventory) PickReserved(ctx context.Context, items map[string]uint) error {
+	return withTx(ctx, i.db, func(tx *sql.Tx) error {
+		for id, qty := range items {
+			q, err := stockQuantity(id, qty)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.ExecContext(ctx, `UPDATE inventory SET quantity = MAX(quantity - ?, 0), reserved = MAX(reserved - ?, 0) WHERE id = ?`, q, q, id)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (i *SQLiteInventory) Delete(ctx context.Context, id string) error {
+	res, err := i.db.ExecContext(ctx, `DELETE FROM inventory WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	return checkAffected(res)
+}
+
+func (i *SQLiteInventory) GetItem(ctx context.Context, id string) (InventoryRecord, error) {
+	return getInventoryRecord(ctx, i.db, id)
+}
+
+func (i *SQLiteInventory) List(ctx context.Context, filter func(InventoryRecord) bool) ([]InventoryRecord, error) {
+	rows, err := i.db.QueryContext(ctx, `SELECT `+inventoryColumns+` FROM inventory ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []InventoryRecord{}
+	for rows.Next() {
+		rec, err := scanInventoryRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		if filter(rec) {
+			records = append(records, rec)
+		}
+	}
+
+	return records, rows.Err()
+}
+
+const inventoryColumns = `id, aisle, price, quantity, reserved`
+
+func getInventoryRecord(ctx context.Context, q rowQueryer, id string) (InventoryRecord, error) {
+	rec, err := scanInventoryRecord(q.QueryRowContext(ctx, `SELECT `+inventoryColumns+` FROM inventory WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return InventoryRecord{}, ErrNotFound
+	}
+
+	return rec, err
+}
+
+func scanInventoryRecord(row scanner) (InventoryRecord, error) {
+	var rec InventoryRecord
+	err := row.Scan(&rec.ID, &rec.Aisle, &rec.Price, &rec.Quantity, &rec.Reserved)
+	return rec, err
+}
+
+// SQLiteUserDB is a UserStore backed by SQLite.
+type SQLiteUserDB struct {
+	db *sql.DB
+}
+
+const userColumns = `username, password_hash, roles, aisles, disabled`
+
+func (udb *SQLiteUserDB) LookupUser(ctx context.Context, userName string) (*UserRecord, error) {
+	return lookupUser(ctx, udb.db, userName)
+}
+
+func (udb *SQLiteUserDB) ListUsers(ctx context.Context, filter func(UserRecord) bool) ([]UserRecord, error) {
+	rows, err := udb.db.QueryContext(ctx, `SELECT `+userColumns+` FROM users ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []UserRecord{}
+	for rows.Next() {
+		rec, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		if filter(*rec) {
+			records = append(records, *rec)
+		}
+	}
+
+	return records, rows.Err()
+}
+
+func (udb *SQLiteUserDB) CreateUser(ctx context.Context, rec UserRecord) error {
+	return withTx(ctx, udb.db, func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE username = ?)`, rec.Username).Scan(&exists); err != nil {
+			return err
+		}
+
+		if exists {
+			return ErrAlreadyExists
+		}
+
+		roles, aisles, err := marshalUserLists(&rec)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?)`,
+			rec.Username, rec.PasswordHash, roles, aisles, rec.Disabled)
+		return err
+	})
+}
+
+func (udb *SQLiteUserDB) UpdateUser(ctx context.Context, userName string, update func(*UserRecord)) error {
+	return withTx(ctx, udb.db, func(tx *sql.Tx) error {
+		rec, err := lookupUser(ctx, tx, userName)
+		if err != nil {
+			return err
+		}
+
+		update(rec)
+
+		roles, aisles, err := marshalUserLists(rec)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE users SET password_hash = ?, roles = ?, aisles = ?, disabled = ? WHERE username = ?`,
+			rec.PasswordHash, roles, aisles, rec.Disabled, userName)
+		return err
+	})
+}
+
+func (udb *SQLiteUserDB) DeleteUser(ctx context.Context, userName string) error {
+	res, err := udb.db.ExecContext(ctx, `DELETE FROM users WHERE username = ?`, userName)
+	if err != nil {
+		return err
+	}
+
+	return checkAffected(res)
+}
+
+// SQLiteAPIKeyDB is an APIKeyStore backed by SQLite.
+type SQLiteAPIKeyDB struct {
+	db *sql.DB
+}
+
+const apiKeyColumns = `id, username, name, roles, hash, created_at, expires_at`
+
+func (kdb *SQLiteAPIKeyDB) CreateAPIKey(ctx context.Context, key APIKey) error {
+	return withTx(ctx, kdb.db, func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM api_keys WHERE id = ?)`, key.ID).Scan(&exists); err != nil {
+			return err
+		}
+
+		if exists {
+			return ErrAlreadyExists
+		}
+
+		roles, err := json.Marshal(nonNil(key.Roles))
+		if err != nil {
+			return err
+		}
+
+		var expiresAt sql.NullString
+		if key.ExpiresAt != nil {
+			expiresAt = sql.NullString{String: key.ExpiresAt.Format(time.RFC3339Nano), Valid: true}
+		}
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO api_keys (`+apiKeyColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			key.ID, key.Username, key.Name, roles, key.Hash, key.CreatedAt.Format(time.RFC3339Nano), expiresAt)
+		return err
+	})
+}
+
+func (kdb *SQLiteAPIKeyDB) GetAPIKey(ctx context.Context, id string) (APIKey, error) {
+	key, err := scanAPIKey(kdb.db.QueryRowContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, ErrNotFound
+	}
+
+	return key, err
+}
+
+func (kdb *SQLiteAPIKeyDB) ListAPIKeys(ctx context.Context, userName string) ([]APIKey, error) {
+	rows, err := kdb.db.QueryContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys WHERE username = ?`, userName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Timestamps are stored as text, so they are sorted here rather than by the query.
+	sortAPIKeys(keys)
+
+	return keys, nil
+}
+
+func (kdb *SQLiteAPIKeyDB) DeleteAPIKey(ctx context.Context, id string) error {
+	res, err := kdb.db.ExecContext(ctx, `DELETE FROM api_keys WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	return checkAffected(res)
+}
+
+func (kdb *SQLiteAPIKeyDB) DeleteUserAPIKeys(ctx context.Context, userName string) error {
+	_, err := kdb.db.ExecContext(ctx, `DELETE FROM api_keys WHERE username = ?`, userName)
+	return err
+}
+
+func scanAPIKey(row scanner) (APIKey, error) {
+	var key APIKey
+	var roles []byte
+	var createdAt string
+	var expiresAt sql.NullString
+	if err := row.Scan(&key.ID, &key.Username, &key.Name, &roles, &key.Hash, &createdAt, &expiresAt); err != nil {
+		return APIKey{}, err
+	}
+
+	if err := json.Unmarshal(roles, &key.Roles); err != nil {
+		return APIKey{}, fmt.Errorf("invalid roles for API key %s: %w", key.ID, err)
+	}
+
+	var err error
+	if key.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+		return APIKey{}, fmt.Errorf("invalid creation time for API key %s: %w", key.ID, err)
+	}
+
+	if expiresAt.Valid {
+		t, err := time.Parse(time.RFC3339Nano, expiresAt.String)
+		if err != nil {
+			return APIKey{}, fmt.Errorf("invalid expiry time for API key %s: %w", key.ID, err)
+		}
+		key.ExpiresAt = &t
+	}
+
+	return key, nil
+}
+
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func lookupUser(ctx context.Context, q rowQueryer, userName string) (*UserRecord, error) {
+	rec, err := scanUser(q.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE username = ?`, userName))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+
+	return rec, err
+}
+
+func scanUser(row scanner) (*UserRecord, error) {
+	var rec UserRecord
+	var roles, aisles []byte
+	if err := row.Scan(&rec.Username, &rec.PasswordHash, &roles, &aisles, &rec.Disabled); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(roles, &rec.Roles); err != nil {
+		return nil, fmt.Errorf("invalid roles for user %s: %w", rec.Username, err)
+	}
+
+	if err := json.Unmarshal(aisles, &rec.Aisles); err != nil {
+		return nil, fmt.Errorf("invalid aisles for user %s: %w", rec.Username, err)
+	}
+
+	return &rec, nil
+}
+
+func marshalUserLists(rec *UserRecord) (roles, aisles []byte, err error) {
+	if roles, err = json.Marshal(nonNil(rec.Roles)); err != nil {
+		return nil, nil, err
+	}
+
+	if aisles, err = json.Marshal(nonNil(rec.Aisles)); err != nil {
+		return nil, nil, err
+	}
+
+	return roles, aisles, nil
+}
+
+func checkAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package db_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/cerbos/demo-rest/db"
+)
+
+// baselineSchema is the schema of the first release, after the demo users were seeded.
+const baselineSchema = `
+CREATE TABLE orders (
+	id     INTEGER PRIMARY KEY AUTOINCREMENT,
+	owner  TEXT NOT NULL,
+	status TEXT NOT NULL,
+	items  TEXT NOT NULL
+);
+
+CREATE TABLE inventory (
+	id       TEXT PRIMARY KEY,
+	aisle    TEXT NOT NULL,
+	price    INTEGER NOT NULL,
+	quantity INTEGER NOT NULL DEFAULT 0 CHECK (quantity >= 0)
+);
+
+CREATE TABLE users (
+	username      TEXT PRIMARY KEY,
+	password_hash BLOB NOT NULL,
+	roles         TEXT NOT NULL,
+	aisles        TEXT NOT NULL
+);
+
+INSERT INTO orders (owner, status, items) VALUES ('adam', 'PENDING', '{"eggs":6}');
+INSERT INTO inventory (id, aisle, price, quantity) VALUES ('eggs', 'dairy', 30, 10);
+INSERT INTO users (username, password_hash, roles, aisles) VALUES ('george', 'hash', '["customer","employee","buyer"]', '["dairy"]');
+
+PRAGMA user_version = 2;`
+
+func userVersion(t *testing.T, path string) int {
+	t.Helper()
+
+	raw, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer raw.Close()
+
+	var version int
+	if err := raw.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		t.Fatalf("Failed to read schema version: %v", err)
+	}
+
+	return version
+}
+
+func TestSQLiteMigratesBaselineSchema(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	raw, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if _, err := raw.ExecContext(ctx, baselineSchema); err != nil {
+		t.Fatalf("Failed to create baseline schema: %v", err)
+	}
+	raw.Close()
+
+	sqlite := openSQLite(t, path)
+
+	orders := sqlite.Orders()
+	o, err := orders.Get(ctx, 1)
+	if err != nil {
+		t.Fatalf("Failed to get order: %v", err)
+	}
+	if o.Owner != "adam" || o.Status != db.StatusPending || o.Items["eggs"] != 6 || len(o.Lines) != 0 {
+		t.Errorf("Expected the order to keep its items, got %+v", o)
+	}
+	if history, err := orders.History(ctx, 1); err != nil || len(history) != 0 {
+		t.Errorf("Expected no history, got %+v: %v", history, err)
+	}
+
+	line, err := db.NewOrderLine("eggs", 4, 30)
+	if err != nil {
+		t.Fatalf("Failed to create order line: %v", err)
+	}
+	if err := orders.Update(ctx, 1, []db.OrderLine{line}, nil); err != nil {
+		t.Fatalf("Failed to update order: %v", err)
+	}
+	if o, err = orders.Get(ctx, 1); err != nil || o.Items["eggs"] != 4 || o.Total != 120 {
+		t.Errorf("Expected the order to be priced, got %+v: %v", o, err)
+	}
+	if id, err := orders.Create(ctx, "eve", nil); err != nil || id != 2 {
+		t.Errorf("Expected order 2 to be created, got %d: %v", id, err)
+	}
+
+	rec, err := sqlite.Inventory().GetItem(ctx, "eggs")
+	if err != nil {
+		t.Fatalf("Failed to get item: %v", err)
+	}
+	if want := (db.InventoryRecord{ID: "eggs", Aisle: "dairy", Price: 30, Quantity: 10}); rec != want {
+		t.Errorf("Expected %+v, got %+v", want, rec)
+	}
+
+	george, err := sqlite.Users().LookupUser(ctx, "george")
+	if err != nil {
+		t.Fatalf("Failed to look up user: %v", err)
+	}
+	if george.Disabled || !slices.Equal(george.Roles, []string{"customer", "employee", "buyer"}) || !slices.Equal(george.Aisles, []string{"dairy"}) {
+		t.Errorf("Expected george to be migrated, got %+v", george)
+	}
+	if _, err := sqlite.Users().LookupUser(ctx, "adam"); err == nil {
+		t.Error("Expected the demo users to be seeded only once")
+	}
+
+	keys := sqlite.APIKeys()
+	if err := keys.CreateAPIKey(ctx, db.APIKey{ID: "k1", Username: "george", Hash: []byte("hash")}); err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+	if list, err := keys.ListAPIKeys(ctx, "george"); err != nil || len(list) != 1 {
+		t.Errorf("Expected one API key, got %+v: %v", list, err)
+	}
+
+	sqlite.Close()
+
+	// Reopening the database must not apply any migration again.
+	openSQLite(t, path).Close()
+
+	freshPath := filepath.Join(t.TempDir(), "fresh.db")
+	openSQLite(t, freshPath).Close()
+	if got, want := userVersion(t, path), userVersion(t, freshPath); got != want {
+		t.Errorf("Expected schema version %d, got %d", want, got)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package db
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInvalidStatus     = errors.New("invalid order status")
+	ErrInvalidTransition = errors.New("invalid order status transition")
+)
+
+// OrderStatus is the stage of fulfilment an order is in.
+type OrderStatus string
+
+const (
+	StatusPending    OrderStatus = "PENDING"
+	StatusPicking    OrderStatus = "PICKING"
+	StatusPicked     OrderStatus = "PICKED"
+	StatusDispatched OrderStatus = "DISPATCHED"
+	StatusDelivered  OrderStatus = "DELIVERED"
+	StatusCancelled  OrderStatus = "CANCELLED"
+	StatusReturned   OrderStatus = "RETURNED"
+)
+
+// statusTransitions lists the statuses that an order can move to from each status.
+var statusTransitions = map[OrderStatus][]OrderStatus{
+	StatusPending:    {StatusPicking, StatusCancelled},
+	StatusPicking:    {StatusPicked, StatusPending, StatusCancelled},
+	StatusPicked:     {StatusDispatched},
+	StatusDispatched: {StatusDelivered, StatusReturned},
+	StatusDelivered:  {StatusReturned},
+	StatusCancelled:  {},
+	StatusReturned:   {},
+}
+
+// ParseOrderStatus converts a string to an OrderStatus, returning ErrInvalidStatus if it is not a known status.
+func ParseOrderStatus(s string) (OrderStatus, error) {
+	status := OrderStatus(s)
+	if _, ok := statusTransitions[status]; !ok {
+		return "", fmt.Errorf("%w: %q", ErrInvalidStatus, s)
+	}
+
+	return status, nil
+}
+
+// NextStatuses returns the statuses that an order in this status can move to.
+func (s OrderStatus) NextStatuses() []OrderStatus {
+	return append([]OrderStatus{}, statusTransitions[s]...)
+}
+
+// CanTransitionTo reports whether an order in this status can move to the given status.
+func (s OrderStatus) CanTransitionTo(to OrderStatus) bool {
+	for _, next := range statusTransitions[s] {
+		if next == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// TransitionError is returned when an order cannot move from its current status to the requested one.
+type TransitionError struct {
+	From    OrderStatus
+	To      OrderStatus
+	Allowed []OrderStatus
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("cannot change order status from %s to %s", e.From, e.To)
+}
+
+func (e *TransitionError) Is(target error) bool {
+	return target == ErrInvalidTransition
+}
+
+func checkTransition(from, to OrderStatus) error {
+	if _, err := ParseOrderStatus(string(to)); err != nil {
+		return err
+	}
+
+	if !from.CanTransitionTo(to) {
+		return &TransitionError{From: from, To: to, Allowed: from.NextStatuses()}
+	}
+
+	return nil
+}
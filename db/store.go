@@ -0,0 +1,77 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package db
+
+import "context"
+
+// OrderHook is called by the OrderStore methods that change an order, with the order as it is before the change,
+// so that related changes such as stock reservations can be made atomically with it. The change is abandoned if the
+// hook returns an error. The SQLite stores run the hook in the transaction that makes the change, and the stores
+// called with the context passed to the hook join that transaction.
+type OrderHook func(ctx context.Context, current Order) error
+
+// OrderStore is the storage backend for customer orders. The methods that change an order take an optional OrderHook.
+type OrderStore interface {
+	Create(ctx context.Context, owner string, lines []OrderLine) (uint64, error)
+	Update(ctx context.Context, orderID uint64, lines []OrderLine, hook OrderHook) error
+	Delete(ctx context.Context, orderID uint64, hook OrderHook) error
+	Get(ctx context.Context, orderID uint64) (Order, error)
+	// SetStatus moves the order to the given status. It returns ErrInvalidStatus if the status is unknown
+	// and a *TransitionError if the order cannot move from its current status to the new one.
+	// The hook is only called if the transition is valid.
+	SetStatus(ctx context.Context, orderID uint64, status OrderStatus, hook OrderHook) error
+	List(ctx context.Context, filter func(Order) bool) ([]Order, error)
+	// History returns the changes made to the order, oldest first. Changes are attributed to the actor
+	// set on the context with WithActor, and the history is retained after the order is deleted.
+	History(ctx context.Context, orderID uint64) ([]HistoryEntry, error)
+}
+
+// InventoryStore is the storage backend for inventory items.
+type InventoryStore interface {
+	Add(ctx context.Context, item InventoryItem) error
+	Update(ctx context.Context, item InventoryItem) error
+	UpdateQuantity(ctx context.Context, id string, quantity int) (int, error)
+	Delete(ctx context.Context, id string) error
+	GetItem(ctx context.Context, id string) (InventoryRecord, error)
+	List(ctx context.Context, filter func(InventoryRecord) bool) ([]InventoryRecord, error)
+	// ReserveStock atomically releases the quantities in release and reserves the quantities in reserve.
+	// If any item to be reserved is unknown or does not have enough available stock, nothing is changed
+	// and a *StockError describing the short lines is returned.
+	ReserveStock(ctx context.Context, release, reserve map[string]uint) error
+	// PickReserved removes previously reserved quantities from stock.
+	PickReserved(ctx context.Context, items map[string]uint) error
+}
+
+// UserStore is the storage backend for user accounts.
+type UserStore interface {
+	LookupUser(ctx context.Context, userName string) (*UserRecord, error)
+	ListUsers(ctx context.Context, filter func(UserRecord) bool) ([]UserRecord, error)
+	CreateUser(ctx context.Context, rec UserRecord) error
+	// UpdateUser applies the given function to the record of the named user atomically.
+	UpdateUser(ctx context.Context, userName string, update func(*UserRecord)) error
+	DeleteUser(ctx context.Context, userName string) error
+}
+
+// APIKeyStore is the storage backend for API keys.
+type APIKeyStore interface {
+	CreateAPIKey(ctx context.Context, key APIKey) error
+	GetAPIKey(ctx context.Context, id string) (APIKey, error)
+	// ListAPIKeys returns the keys that belong to the named user, oldest first.
+	ListAPIKeys(ctx context.Context, userName string) ([]APIKey, error)
+	DeleteAPIKey(ctx context.Context, id string) error
+	// DeleteUserAPIKeys removes all the keys that belong to the named user.
+	DeleteUserAPIKeys(ctx context.Context, userName string) error
+}
+
+var (
+	_ OrderStore     = (*OrderDB)(nil)
+	_ InventoryStore = (*Inventory)(nil)
+	_ UserStore      = (*UserDB)(nil)
+	_ APIKeyStore    = (*APIKeyDB)(nil)
+
+	_ OrderStore     = (*SQLiteOrderDB)(nil)
+	_ InventoryStore = (*SQLiteInventory)(nil)
+	_ UserStore      = (*SQLiteUserDB)(nil)
+	_ APIKeyStore    = (*SQLiteAPIKeyDB)(nil)
+)
@@ -0,0 +1,45 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package db_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/cerbos/demo-rest/db"
+)
+
+// storeSet holds the stores of one backend. Tests run against every backend returned by stores.
+type storeSet struct {
+	orders    db.OrderStore
+	inventory db.InventoryStore
+	users     db.UserStore
+	apiKeys   db.APIKeyStore
+	// atomic is set if changes made by a failed order hook are rolled back.
+	atomic bool
+}
+
+func stores(t *testing.T) map[string]storeSet {
+	t.Helper()
+
+	sqlite := openSQLite(t, filepath.Join(t.TempDir(), "test.db"))
+
+	return map[string]storeSet{
+		"memory": {orders: db.NewOrderDB(), inventory: db.NewInventory(), users: db.NewUserDB(), apiKeys: db.NewAPIKeyDB()},
+		"sqlite": {orders: sqlite.Orders(), inventory: sqlite.Inventory(), users: sqlite.Users(), apiKeys: sqlite.APIKeys(), atomic: true},
+	}
+}
+
+func openSQLite(t *testing.T, path string) *db.SQLite {
+	t.Helper()
+
+	sqlite, err := db.OpenSQLite(context.Background(), path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { sqlite.Close() })
+
+	return sqlite
+}
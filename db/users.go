@@ -5,12 +5,16 @@ package db
 
 import (
 	"context"
+	"sort"
+	"sync"
 )
 
 type UserRecord struct {
+	Username     string
 	PasswordHash []byte
 	Roles        []string
 	Aisles       []string
+	Disabled     bool
 }
 
 var users = map[string]*UserRecord{
@@ -62,12 +66,124 @@ var users = map[string]*UserRecord{
 	},
 }
 
-// LookupUser retrieves the record for the given username from the database.
+// DefaultUserStore is the store consulted by LookupUser.
+// It holds the built-in demo users until it is replaced at startup.
+var DefaultUserStore UserStore = NewUserDB()
+
+// LookupUser retrieves the record for the given username from the default user store.
 func LookupUser(ctx context.Context, userName string) (*UserRecord, error) {
-	rec, ok := users[userName]
+	return DefaultUserStore.LookupUser(ctx, userName)
+}
+
+// Attr returns the value of the named user attribute as exposed to Cerbos policies.
+func (u UserRecord) Attr(name string) (any, bool) {
+	switch name {
+	case "username":
+		return u.Username, true
+	case "roles":
+		return u.Roles, true
+	case "aisles":
+		return u.Aisles, true
+	case "disabled":
+		return u.Disabled, true
+	default:
+		return nil, false
+	}
+}
+
+// clone returns a deep copy of the record so that callers cannot modify the stored data.
+func (u *UserRecord) clone() *UserRecord {
+	c := *u
+	c.PasswordHash = append([]byte(nil), u.PasswordHash...)
+	c.Roles = append([]string(nil), u.Roles...)
+	c.Aisles = append([]string(nil), u.Aisles...)
+	return &c
+}
+
+// UserDB is an in-memory UserStore initialised with the built-in demo users.
+type UserDB struct {
+	mu    sync.RWMutex
+	users map[string]*UserRecord
+}
+
+func NewUserDB() *UserDB {
+	udb := &UserDB{users: make(map[string]*UserRecord, len(users))}
+	for name, rec := range users {
+		u := rec.clone()
+		u.Username = name
+		udb.users[name] = u
+	}
+
+	return udb
+}
+
+func (udb *UserDB) LookupUser(ctx context.Context, userName string) (*UserRecord, error) {
+	udb.mu.RLock()
+	defer udb.mu.RUnlock()
+
+	rec, ok := udb.users[userName]
 	if !ok {
 		return nil, ErrNotFound
 	}
 
-	return rec, nil
+	return rec.clone(), nil
+}
+
+func (udb *UserDB) ListUsers(ctx context.Context, filter func(UserRecord) bool) ([]UserRecord, error) {
+	udb.mu.RLock()
+	defer udb.mu.RUnlock()
+
+	records := make([]UserRecord, 0, len(udb.users))
+	for _, rec := range udb.users {
+		if filter(*rec) {
+			records = append(records, *rec.clone())
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Username < records[j].Username })
+
+	return records, nil
+}
+
+func (udb *UserDB) CreateUser(ctx context.Context, rec UserRecord) error {
+	udb.mu.Lock()
+	defer udb.mu.Unlock()
+
+	if _, ok := udb.users[rec.Username]; ok {
+		return ErrAlreadyExists
+	}
+
+	udb.users[rec.Username] = rec.clone()
+
+	return nil
+}
+
+func (udb *UserDB) UpdateUser(ctx context.Context, userName string, update func(*UserRecord)) error {
+	udb.mu.Lock()
+	defer udb.mu.Unlock()
+
+	rec, ok := udb.users[userName]
+	if !ok {
+		return ErrNotFound
+	}
+
+	updated := rec.clone()
+	update(updated)
+	updated.Username = userName
+	udb.users[userName] = updated
+
+	return nil
+}
+
+func (udb *UserDB) DeleteUser(ctx context.Context, userName string) error {
+	udb.mu.Lock()
+	defer udb.mu.Unlock()
+
+	if _, ok := udb.users[userName]; !ok {
+		return ErrNotFound
+	}
+
+	delete(udb.users, userName)
+
+	return nil
 }
@@ -0,0 +1,90 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package db_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/cerbos/demo-rest/db"
+)
+
+func TestUserStore(t *testing.T) {
+	for name, s := range stores(t) {
+		users := s.users
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			florence, err := users.LookupUser(ctx, "florence")
+			if err != nil {
+				t.Fatalf("Failed to look up user: %v", err)
+			}
+			if florence.Username != "florence" || len(florence.PasswordHash) == 0 || florence.Disabled ||
+				!slices.Equal(florence.Roles, []string{"customer", "employee", "buyer"}) || !slices.Equal(florence.Aisles, []string{"bakery"}) {
+				t.Errorf("Expected the demo user florence, got %+v", florence)
+			}
+
+			ivy := db.UserRecord{Username: "ivy", PasswordHash: []byte("hash"), Roles: []string{"customer"}}
+			if err := users.CreateUser(ctx, ivy); err != nil {
+				t.Fatalf("Failed to create user: %v", err)
+			}
+			if err := users.CreateUser(ctx, db.UserRecord{Username: "ivy", Roles: []string{"admin"}}); !errors.Is(err, db.ErrAlreadyExists) {
+				t.Errorf("Expected ErrAlreadyExists, got %v", err)
+			}
+
+			err = users.UpdateUser(ctx, "ivy", func(u *db.UserRecord) {
+				u.Roles = append(u.Roles, "employee", "buyer")
+				u.Aisles = []string{"dairy"}
+				u.Disabled = true
+			})
+			if err != nil {
+				t.Fatalf("Failed to update user: %v", err)
+			}
+
+			got, err := users.LookupUser(ctx, "ivy")
+			if err != nil {
+				t.Fatalf("Failed to look up user: %v", err)
+			}
+			if got.Username != "ivy" || string(got.PasswordHash) != "hash" || !got.Disabled ||
+				!slices.Equal(got.Roles, []string{"customer", "employee", "buyer"}) || !slices.Equal(got.Aisles, []string{"dairy"}) {
+				t.Errorf("Unexpected user %+v", got)
+			}
+
+			// Records returned by the store are copies.
+			got.Roles[0] = "admin"
+			if got, err = users.LookupUser(ctx, "ivy"); err != nil || got.Roles[0] != "customer" {
+				t.Errorf("Expected the stored roles to be unchanged, got %+v: %v", got, err)
+			}
+
+			buyers, err := users.ListUsers(ctx, func(u db.UserRecord) bool { return slices.Contains(u.Roles, "buyer") })
+			if err != nil {
+				t.Fatalf("Failed to list users: %v", err)
+			}
+			var names []string
+			for _, u := range buyers {
+				names = append(names, u.Username)
+			}
+			if !slices.Equal(names, []string{"florence", "george", "ivy"}) {
+				t.Errorf("Expected florence, george and ivy, got %v", names)
+			}
+
+			if err := users.DeleteUser(ctx, "ivy"); err != nil {
+				t.Fatalf("Failed to delete user: %v", err)
+			}
+
+			testCases := map[string]func() error{
+				"lookup": func() error { _, err := users.LookupUser(ctx, "ivy"); return err },
+				"update": func() error { return users.UpdateUser(ctx, "ivy", func(*db.UserRecord) {}) },
+				"delete": func() error { return users.DeleteUser(ctx, "ivy") },
+			}
+
+			for op, fn := range testCases {
+				if err := fn(); !errors.Is(err, db.ErrNotFound) {
+					t.Errorf("%s: expected ErrNotFound, got %v", op, err)
+				}
+			}
+		})
+	}
+}
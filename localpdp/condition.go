@@ -0,0 +1,192 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package localpdp
+
+import (
+	"fmt"
+	"slices"
+
+	policyv1 "github.com/cerbos/cerbos/api/genpb/cerbos/policy/v1"
+	"github.com/google/cel-go/cel"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+type matchOp int
+
+const (
+	matchExpr matchOp = iota
+	matchAll
+	matchAny
+	matchNone
+)
+
+// condition is a compiled match block of a policy.
+type condition struct {
+	op       matchOp
+	children []*condition
+	// ast, program and partial are only set for matchExpr. partial evaluates the expression with unknown resource attributes.
+	ast     *cel.Ast
+	program cel.Program
+	partial cel.Program
+}
+
+func newEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("request", cel.DynType),
+		cel.Variable("P", cel.DynType),
+		cel.Variable("R", cel.DynType),
+		cel.CrossTypeNumericComparisons(true),
+	)
+}
+
+func (e *Engine) compileCondition(c *policyv1.Condition) (*condition, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	if c.GetScript() != "" {
+		return nil, fmt.Errorf("%w: script conditions", ErrUnsupported)
+	}
+
+	return e.compileMatch(c.GetMatch())
+}
+
+func (e *Engine) compileMatch(m *policyv1.Match) (*condition, error) {
+	var op matchOp
+	var list *policyv1.Match_ExprList
+	switch node := m.GetOp().(type) {
+	case *policyv1.Match_Expr:
+		return e.compileExpr(node.Expr)
+	case *policyv1.Match_All:
+		op, list = matchAll, node.All
+	case *policyv1.Match_Any:
+		op, list = matchAny, node.Any
+	case *policyv1.Match_None:
+		op, list = matchNone, node.None
+	default:
+		return nil, fmt.Errorf("empty match")
+	}
+
+	cond := &condition{op: op}
+	for _, child := range list.GetOf() {
+		cc, err := e.compileMatch(child)
+		if err != nil {
+			return nil, err
+		}
+		cond.children = append(cond.children, cc)
+	}
+
+	return cond, nil
+}
+
+func (e *Engine) compileExpr(expr string) (*condition, error) {
+	ast, iss := e.env.Compile(expr)
+	if iss.Err() != nil {
+		return nil, fmt.Errorf("failed to compile %q: %w", expr, iss.Err())
+	}
+
+	// Auxiliary data such as the JWT is only sent to Cerbos, so conditions on it would always fail here.
+	parsed, err := cel.AstToParsedExpr(ast)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile %q: %w", expr, err)
+	}
+	if refersToAuxData(parsed.GetExpr()) {
+		return nil, fmt.Errorf("%w: auxiliary data in %q", ErrUnsupported, expr)
+	}
+
+	program, err := e.env.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile %q: %w", expr, err)
+	}
+
+	partial, err := e.env.Program(ast, cel.EvalOptions(cel.OptTrackState, cel.OptPartialEval))
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile %q: %w", expr, err)
+	}
+
+	return &condition{op: matchExpr, ast: ast, program: program, partial: partial}, nil
+}
+
+// eval reports whether the condition is satisfied. A nil condition is always satisfied and,
+// as in Cerbos, an expression that fails to evaluate is not.
+func (c *condition) eval(vars map[string]any) bool {
+	if c == nil {
+		return true
+	}
+
+	switch c.op {
+	case matchAll:
+		for _, child := range c.children {
+			if !child.eval(vars) {
+				return false
+			}
+		}
+		return true
+
+	case matchAny:
+		for _, child := range c.children {
+			if child.eval(vars) {
+				return true
+			}
+		}
+		return false
+
+	case matchNone:
+		for _, child := range c.children {
+			if child.eval(vars) {
+				return false
+			}
+		}
+		return true
+
+	default:
+		out, _, err := c.program.Eval(vars)
+		if err != nil {
+			return false
+		}
+
+		b, ok := out.Value().(bool)
+		return ok && b
+	}
+}
+
+// refersToAuxData reports whether the expression refers to request.aux_data.
+func refersToAuxData(expr *exprpb.Expr) bool {
+	switch e := expr.GetExprKind().(type) {
+	case *exprpb.Expr_SelectExpr:
+		if e.SelectExpr.GetField() == "aux_data" && e.SelectExpr.GetOperand().GetIdentExpr().GetName() == "request" {
+			return true
+		}
+		return refersToAuxData(e.SelectExpr.GetOperand())
+
+	case *exprpb.Expr_CallExpr:
+		args := e.CallExpr.GetArgs()
+		if e.CallExpr.GetFunction() == "_[_]" && len(args) == 2 &&
+			args[0].GetIdentExpr().GetName() == "request" && args[1].GetConstExpr().GetStringValue() == "aux_data" {
+			return true
+		}
+		if t := e.CallExpr.GetTarget(); t != nil && refersToAuxData(t) {
+			return true
+		}
+		return slices.ContainsFunc(args, refersToAuxData)
+
+	case *exprpb.Expr_ListExpr:
+		return slices.ContainsFunc(e.ListExpr.GetElements(), refersToAuxData)
+
+	case *exprpb.Expr_StructExpr:
+		for _, entry := range e.StructExpr.GetEntries() {
+			if refersToAuxData(entry.GetMapKey()) || refersToAuxData(entry.GetValue()) {
+				return true
+			}
+		}
+		return false
+
+	case *exprpb.Expr_ComprehensionExpr:
+		c := e.ComprehensionExpr
+		return slices.ContainsFunc([]*exprpb.Expr{c.GetIterRange(), c.GetAccuInit(), c.GetLoopCondition(), c.GetLoopStep(), c.GetResult()}, refersToAuxData)
+
+	default:
+		return false
+	}
+}
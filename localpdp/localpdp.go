@@ -0,0 +1,320 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package localpdp evaluates Cerbos policies in-process. It supports the subset of the policy language used by this
+// service: resource policies with role and derived role rules and CEL conditions on the principal and resource.
+// Conditions on auxiliary data are rejected because it is only sent to Cerbos. Policies are matched on the policy version and scope of the resource. Scoped policies override the rules of their
+// parent scopes, as they do in Cerbos by default.
+package localpdp
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/cerbos/cerbos-sdk-go/cerbos"
+	effectv1 "github.com/cerbos/cerbos/api/genpb/cerbos/effect/v1"
+	enginev1 "github.com/cerbos/cerbos/api/genpb/cerbos/engine/v1"
+	policyv1 "github.com/cerbos/cerbos/api/genpb/cerbos/policy/v1"
+	"github.com/google/cel-go/cel"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	defaultVersion = "default"
+	anyRole        = "*"
+	anyAction      = "*"
+)
+
+// ErrUnsupported is returned when a policy uses a feature that the engine cannot evaluate.
+var ErrUnsupported = errors.New("unsupported policy feature")
+
+// Engine evaluates a set of policies. It is safe for concurrent use.
+type Engine struct {
+	env       *cel.Env
+	resources map[policyKey]*resourcePolicy
+}
+
+// policyKey identifies a resource policy. A resource kind can have a policy for each version and scope.
+type policyKey struct {
+	kind    string
+	version string
+	scope   string
+}
+
+type resourcePolicy struct {
+	derivedRoles []*derivedRole
+	rules        []*rule
+}
+
+type derivedRole struct {
+	name        string
+	parentRoles []string
+	// condition is nil if the role is unconditional.
+	condition *condition
+}
+
+type rule struct {
+	actions      []string
+	roles        []string
+	derivedRoles []string
+	// condition is nil if the rule is unconditional.
+	condition *condition
+	effect    effectv1.Effect
+}
+
+// Load reads the YAML or JSON policies in the given directory and its subdirectories.
+func Load(dir string) (*Engine, error) {
+	env, err := newEnv()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CEL environment: %w", err)
+	}
+
+	var policies []*policyv1.Policy
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml", ".json":
+		default:
+			return nil
+		}
+
+		ps, err := cerbos.NewPolicySet().AddPolicyFromFileWithErr(path)
+		if err != nil {
+			return err
+		}
+		policies = append(policies, ps.GetPolicies()...)
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policies from %s: %w", dir, err)
+	}
+
+	return newEngine(env, policies)
+}
+
+func newEngine(env *cel.Env, policies []*policyv1.Policy) (*Engine, error) {
+	e := &Engine{env: env, resources: make(map[policyKey]*resourcePolicy)}
+
+	// Derived roles must be compiled first so that resource policies can import them.
+	derived := make(map[string][]*derivedRole)
+	for _, p := range policies {
+		dr := p.GetDerivedRoles()
+		if dr == nil || p.GetDisabled() {
+			continue
+		}
+
+		if len(dr.GetVariables().GetLocal()) > 0 || len(dr.GetVariables().GetImport()) > 0 {
+			return nil, fmt.Errorf("%w: variables in derived roles %q", ErrUnsupported, dr.GetName())
+		}
+
+		for _, def := range dr.GetDefinitions() {
+			cond, err := e.compileCondition(def.GetCondition())
+			if err != nil {
+				return nil, fmt.Errorf("invalid derived role %q in %q: %w", def.GetName(), dr.GetName(), err)
+			}
+			derived[dr.GetName()] = append(derived[dr.GetName()], &derivedRole{name: def.GetName(), parentRoles: def.GetParentRoles(), condition: cond})
+		}
+	}
+
+	for _, p := range policies {
+		if p.GetDisabled() {
+			continue
+		}
+
+		switch pt := p.GetPolicyType().(type) {
+		case *policyv1.Policy_DerivedRoles:
+		case *policyv1.Policy_ResourcePolicy:
+			rp := pt.ResourcePolicy
+			if err := e.addResourcePolicy(rp, derived); err != nil {
+				return nil, fmt.Errorf("invalid resource policy for %q: %w", rp.GetResource(), err)
+			}
+		default:
+			return nil, fmt.Errorf("%w: policy type %T", ErrUnsupported, pt)
+		}
+	}
+
+	return e, nil
+}
+
+func (e *Engine) addResourcePolicy(rp *policyv1.ResourcePolicy, derived map[string][]*derivedRole) error {
+	if len(rp.GetVariables().GetLocal()) > 0 || len(rp.GetVariables().GetImport()) > 0 {
+		return fmt.Errorf("%w: variables", ErrUnsupported)
+	}
+
+	key := policyKey{kind: rp.GetResource(), version: rp.GetVersion(), scope: rp.GetScope()}
+	if _, ok := e.resources[key]; ok {
+		return fmt.Errorf("duplicate policy for version %q and scope %q", key.version, key.scope)
+	}
+
+	p := &resourcePolicy{}
+	for _, name := range rp.GetImportDerivedRoles() {
+		roles, ok := derived[name]
+		if !ok {
+			return fmt.Errorf("unknown derived roles %q", name)
+		}
+		p.derivedRoles = append(p.derivedRoles, roles...)
+	}
+
+	for i, r := range rp.GetRules() {
+		for _, name := range r.GetDerivedRoles() {
+			if !slices.ContainsFunc(p.derivedRoles, func(dr *derivedRole) bool { return dr.name == name }) {
+				return fmt.Errorf("rule #%d refers to derived role %q, which is not imported", i+1, name)
+			}
+		}
+
+		cond, err := e.compileCondition(r.GetCondition())
+		if err != nil {
+			return fmt.Errorf("invalid condition in rule #%d: %w", i+1, err)
+		}
+
+		p.rules = append(p.rules, &rule{
+			actions:      r.GetActions(),
+			roles:        r.GetRoles(),
+			derivedRoles: r.GetDerivedRoles(),
+			condition:    cond,
+			effect:       r.GetEffect(),
+		})
+	}
+
+	e.resources[key] = p
+	return nil
+}
+
+// policies returns the policies for the policy version and scope of the resource, from the most specific scope to the
+// root scope. As in Cerbos, no policies apply unless there is one for the scope of the resource and each of its parents.
+func (e *Engine) policies(resource *enginev1.Resource) []*resourcePolicy {
+	version := resource.GetPolicyVersion()
+	if version == "" {
+		version = defaultVersion
+	}
+
+	var chain []*resourcePolicy
+	for _, scope := range scopeChain(resource.GetScope()) {
+		p, ok := e.resources[policyKey{kind: resource.GetKind(), version: version, scope: scope}]
+		if !ok {
+			return nil
+		}
+		chain = append(chain, p)
+	}
+
+	return chain
+}
+
+// scopeChain returns the scope and its parents, ending with the root scope. The scope "a.b" has the parents "a" and "".
+func scopeChain(scope string) []string {
+	chain := []string{scope}
+	for scope != "" {
+		i := strings.LastIndexByte(scope, '.')
+		scope = scope[:max(i, 0)]
+		chain = append(chain, scope)
+	}
+
+	return chain
+}
+
+// Check returns the effect of each action on the resource for the principal. Each action is decided by the policy
+// of the most specific scope that has a rule for it. Actions that are not allowed by any rule, and all actions on
+// resources without a policy for their version and scope, are denied.
+func (e *Engine) Check(principal *enginev1.Principal, resource *enginev1.Resource, actions []string) map[string]effectv1.Effect {
+	effects := make(map[string]effectv1.Effect, len(actions))
+	for _, action := range actions {
+		effects[action] = effectv1.Effect_EFFECT_DENY
+	}
+
+	vars := activation(principal, resource)
+	decided := make(map[string]bool, len(actions))
+	for _, p := range e.policies(resource) {
+		derivedRoles := make(map[string]bool, len(p.derivedRoles))
+		for _, dr := range p.derivedRoles {
+			if hasRole(principal.GetRoles(), dr.parentRoles) && dr.condition.eval(vars) {
+				derivedRoles[dr.name] = true
+			}
+		}
+
+		for _, action := range actions {
+			if decided[action] {
+				continue
+			}
+
+			for _, r := range p.rules {
+				if !r.matchesAction(action) {
+					continue
+				}
+
+				if !hasRole(principal.GetRoles(), r.roles) && !slices.ContainsFunc(r.derivedRoles, func(name string) bool { return derivedRoles[name] }) {
+					continue
+				}
+
+				if !r.condition.eval(vars) {
+					continue
+				}
+
+				// A matching DENY rule overrides any ALLOW rule.
+				decided[action] = true
+				effects[action] = r.effect
+				if r.effect == effectv1.Effect_EFFECT_DENY {
+					break
+				}
+			}
+		}
+	}
+
+	return effects
+}
+
+func (r *rule) matchesAction(action string) bool {
+	return slices.Contains(r.actions, action) || slices.Contains(r.actions, anyAction)
+}
+
+// hasRole reports whether any of the principal's roles is one of the given roles.
+func hasRole(principalRoles, roles []string) bool {
+	if slices.Contains(roles, anyRole) {
+		return true
+	}
+
+	return slices.ContainsFunc(principalRoles, func(role string) bool { return slices.Contains(roles, role) })
+}
+
+// activation returns the variables available to conditions. The principal and resource can be referred to by their
+// full names, request.principal and request.resource, or their short names, P and R.
+func activation(principal *enginev1.Principal, resource *enginev1.Resource) map[string]any {
+	roles := make([]any, len(principal.GetRoles()))
+	for i, role := range principal.GetRoles() {
+		roles[i] = role
+	}
+
+	p := map[string]any{
+		"id":    principal.GetId(),
+		"roles": roles,
+		"attr":  AttrValues(principal.GetAttr()),
+	}
+	r := map[string]any{
+		"kind": resource.GetKind(),
+		"id":   resource.GetId(),
+		"attr": AttrValues(resource.GetAttr()),
+	}
+
+	return map[string]any{
+		"request": map[string]any{"principal": p, "resource": r},
+		"P":       p,
+		"R":       r,
+	}
+}
+
+// AttrValues converts Cerbos attributes to plain Go values.
+func AttrValues(attr map[string]*structpb.Value) map[string]any {
+	values := make(map[string]any, len(attr))
+	for k, v := range attr {
+		values[k] = v.AsInterface()
+	}
+
+	return values
+}
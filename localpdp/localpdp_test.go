@@ -0,0 +1,355 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package localpdp_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cerbos/cerbos-sdk-go/cerbos"
+	effectv1 "github.com/cerbos/cerbos/api/genpb/cerbos/effect/v1"
+	enginev1 "github.com/cerbos/cerbos/api/genpb/cerbos/engine/v1"
+	"github.com/cerbos/demo-rest/localpdp"
+	"github.com/cerbos/demo-rest/queryplan"
+)
+
+func loadEngine(t *testing.T, dir string) *localpdp.Engine {
+	t.Helper()
+
+	engine, err := localpdp.Load(dir)
+	if err != nil {
+		t.Fatalf("Failed to load policies: %v", err)
+	}
+
+	return engine
+}
+
+func principal(id string, roles ...string) *cerbos.Principal {
+	return cerbos.NewPrincipal(id, roles...).WithAttr("authMethod", "basic")
+}
+
+func order(owner, status string) *cerbos.Resource {
+	return cerbos.NewResource("order", "1").
+		WithAttr("owner", owner).
+		WithAttr("status", status).
+		WithAttr("items", map[string]any{"eggs": 12, "milk": 1}).
+		WithAttr("total", 450)
+}
+
+func item(aisle string, price, newPrice int) *cerbos.Resource {
+	return cerbos.NewResource("inventory", "bread").
+		WithAttr("aisle", aisle).
+		WithAttr("price", price).
+		WithAttr("newAisle", aisle).
+		WithAttr("newPrice", newPrice)
+}
+
+func user(name string) *cerbos.Resource {
+	return cerbos.NewResource("user", name).WithAttr("username", name)
+}
+
+type checkCase struct {
+	name      string
+	principal *cerbos.Principal
+	resource  *cerbos.Resource
+	action    string
+	want      bool
+}
+
+func runChecks(t *testing.T, engine *localpdp.Engine, testCases []checkCase) {
+	t.Helper()
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			effects := engine.Check(tc.principal.Obj, tc.resource.Obj, []string{tc.action})
+			if got := effects[tc.action] == effectv1.Effect_EFFECT_ALLOW; got != tc.want {
+				t.Errorf("Expected allowed to be %t, got %s", tc.want, effects[tc.action])
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	engine := loadEngine(t, "../cerbos/policies")
+
+	adam := principal("adam", "customer")
+	eve := principal("eve", "customer")
+	bella := principal("bella", "customer", "employee", "manager")
+	charlie := principal("charlie", "customer", "employee", "picker")
+	florence := principal("florence", "customer", "employee", "buyer").WithAttr("aisles", []any{"bakery"})
+
+	runChecks(t, engine, []checkCase{
+		{name: "owner views order", principal: adam, resource: order("adam", "PENDING"), action: "VIEW", want: true},
+		{name: "other customer views order", principal: eve, resource: order("adam", "PENDING"), action: "VIEW", want: false},
+		{name: "employee views order", principal: charlie, resource: order("adam", "PENDING"), action: "VIEW", want: true},
+		{name: "owner updates pending order", principal: adam, resource: order("adam", "PENDING"), action: "UPDATE", want: true},
+		{name: "owner updates picking order", principal: adam, resource: order("adam", "PICKING"), action: "UPDATE", want: false},
+		{
+			name: "picker starts picking", principal: charlie, action: "UPDATE_STATUS", want: true,
+			resource: order("adam", "PENDING").WithAttr("newStatus", "PICKING"),
+		},
+		{
+			name: "picker skips picking", principal: charlie, action: "UPDATE_STATUS", want: false,
+			resource: order("adam", "PENDING").WithAttr("newStatus", "PICKED"),
+		},
+		{
+			name: "manager updates any status", principal: bella, action: "UPDATE_STATUS", want: true,
+			resource: order("adam", "PENDING").WithAttr("newStatus", "CANCELLED"),
+		},
+		{name: "buyer raises price in own aisle", principal: florence, resource: item("bakery", 100, 110), action: "UPDATE", want: true},
+		{name: "buyer raises price too much", principal: florence, resource: item("bakery", 100, 120), action: "UPDATE", want: false},
+		{name: "buyer updates another aisle", principal: florence, resource: item("dairy", 100, 100), action: "UPDATE", want: false},
+		{name: "customer views inventory", principal: adam, resource: item("bakery", 100, 100), action: "VIEW", want: false},
+		{name: "user changes own password", principal: adam, resource: user("adam"), action: "CHANGE_PASSWORD", want: true},
+		{name: "user resets own password", principal: adam, resource: user("adam"), action: "RESET_PASSWORD", want: false},
+		{
+			name: "API key changes own password", principal: principal("adam", "customer").WithAttr("authMethod", "apikey"),
+			resource: user("adam"), action: "CHANGE_PASSWORD", want: false,
+		},
+		{name: "manager disables another user", principal: bella, resource: user("adam"), action: "DISABLE", want: true},
+		{name: "manager disables herself", principal: bella, resource: user("bella"), action: "DISABLE", want: false},
+		{name: "unknown kind", principal: bella, resource: cerbos.NewResource("invoice", "1"), action: "VIEW", want: false},
+		{name: "unknown version", principal: bella, resource: order("adam", "PENDING").WithPolicyVersion("v2"), action: "VIEW", want: false},
+		{name: "unknown scope", principal: bella, resource: order("adam", "PENDING").WithScope("acme"), action: "VIEW", want: false},
+	})
+}
+
+// documentPolicies are written to a temporary directory to test policy versions and scopes.
+var documentPolicies = map[string]string{
+	"root.yaml": `---
+apiVersion: api.cerbos.dev/v1
+resourcePolicy:
+  version: default
+  resource: document
+  rules:
+    - actions: ["VIEW", "SHARE"]
+      roles: ["user"]
+      effect: EFFECT_ALLOW
+    - actions: ["SHARE"]
+      roles: ["user"]
+      effect: EFFECT_DENY
+      condition:
+        match:
+          expr: R.attr.secret == true || R.attr.draft == true
+`,
+	"acme.yaml": `---
+apiVersion: api.cerbos.dev/v1
+resourcePolicy:
+  version: default
+  scope: acme
+  resource: document
+  rules:
+    - actions: ["VIEW"]
+      roles: ["user"]
+      effect: EFFECT_DENY
+      condition:
+        match:
+          expr: R.attr.secret == true
+    - actions: ["EDIT"]
+      roles: ["user"]
+      effect: EFFECT_ALLOW
+`,
+	"v2.yaml": `---
+apiVersion: api.cerbos.dev/v1
+resourcePolicy:
+  version: v2
+  resource: document
+  rules:
+    - actions: ["DELETE"]
+      roles: ["user"]
+      effect: EFFECT_ALLOW
+`,
+}
+
+func documentEngine(t *testing.T) *localpdp.Engine {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, policy := range documentPolicies {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(policy), 0o600); err != nil {
+			t.Fatalf("Failed to write policy: %v", err)
+		}
+	}
+
+	return loadEngine(t, dir)
+}
+
+func document(secret bool) *cerbos.Resource {
+	return cerbos.NewResource("document", "1").WithAttr("secret", secret)
+}
+
+func TestCheckVersionsAndScopes(t *testing.T) {
+	engine := documentEngine(t)
+	alice := principal("alice", "user")
+
+	runChecks(t, engine, []checkCase{
+		{name: "root scope", principal: alice, resource: document(true), action: "VIEW", want: true},
+		{name: "root scope has no rule", principal: alice, resource: document(false), action: "EDIT", want: false},
+		{name: "scope falls back to parent", principal: alice, resource: document(false).WithScope("acme"), action: "VIEW", want: true},
+		{name: "scope overrides parent", principal: alice, resource: document(true).WithScope("acme"), action: "VIEW", want: false},
+		{name: "scope adds rule", principal: alice, resource: document(false).WithScope("acme"), action: "EDIT", want: true},
+		{name: "missing scope", principal: alice, resource: document(false).WithScope("acme.hr"), action: "VIEW", want: false},
+		{name: "unknown scope", principal: alice, resource: document(false).WithScope("globex"), action: "VIEW", want: false},
+		{name: "version", principal: alice, resource: document(false).WithPolicyVersion("v2"), action: "DELETE", want: true},
+		{name: "version does not use default rules", principal: alice, resource: document(false).WithPolicyVersion("v2"), action: "VIEW", want: false},
+		{name: "default version does not use other rules", principal: alice, resource: document(false), action: "DELETE", want: false},
+		{name: "unknown version", principal: alice, resource: document(false).WithPolicyVersion("v3"), action: "VIEW", want: false},
+	})
+}
+
+// planCase checks the filter returned by Plan against records. The records are only checked if the plan is conditional.
+type planCase struct {
+	name      string
+	engine    *localpdp.Engine
+	principal *cerbos.Principal
+	resource  *cerbos.Resource
+	action    string
+	wantKind  enginev1.PlanResourcesFilter_Kind
+	records   map[string]bool
+}
+
+func TestPlan(t *testing.T) {
+	engine := loadEngine(t, "../cerbos/policies")
+	documents := documentEngine(t)
+
+	adam := principal("adam", "customer")
+	bella := principal("bella", "customer", "employee", "manager")
+	florence := principal("florence", "customer", "employee", "buyer").WithAttr("aisles", []any{"bakery"})
+	alice := principal("alice", "user")
+
+	records := map[string]map[string]any{
+		"adam's order":      {"owner": "adam", "status": "PENDING"},
+		"eve's order":       {"owner": "eve", "status": "PENDING"},
+		"bakery item":       {"aisle": "bakery"},
+		"dairy item":        {"aisle": "dairy"},
+		"secret document":   {"secret": true},
+		"public document":   {"secret": false},
+		"untagged document": {},
+		"final document":    {"secret": false, "draft": false},
+		"draft document":    {"secret": false, "draft": true},
+		"undated document":  {"draft": false},
+	}
+
+	testCases := []planCase{
+		{
+			name: "customer views orders", engine: engine, principal: adam, resource: cerbos.NewResource("order", "any"), action: "VIEW",
+			wantKind: enginev1.PlanResourcesFilter_KIND_CONDITIONAL, records: map[string]bool{"adam's order": true, "eve's order": false},
+		},
+		{
+			name: "manager views orders", engine: engine, principal: bella, resource: cerbos.NewResource("order", "any"), action: "VIEW",
+			wantKind: enginev1.PlanResourcesFilter_KIND_ALWAYS_ALLOWED,
+		},
+		{
+			name: "buyer deletes items", engine: engine, principal: florence, resource: cerbos.NewResource("inventory", "any"), action: "DELETE",
+			wantKind: enginev1.PlanResourcesFilter_KIND_CONDITIONAL, records: map[string]bool{"bakery item": true, "dairy item": false},
+		},
+		{
+			name: "customer views inventory", engine: engine, principal: adam, resource: cerbos.NewResource("inventory", "any"), action: "VIEW",
+			wantKind: enginev1.PlanResourcesFilter_KIND_ALWAYS_DENIED,
+		},
+		{
+			name: "unknown kind", engine: engine, principal: bella, resource: cerbos.NewResource("invoice", "any"), action: "VIEW",
+			wantKind: enginev1.PlanResourcesFilter_KIND_ALWAYS_DENIED,
+		},
+		{
+			name: "unknown version", engine: engine, principal: bella, resource: cerbos.NewResource("order", "any").WithPolicyVersion("v2"), action: "VIEW",
+			wantKind: enginev1.PlanResourcesFilter_KIND_ALWAYS_DENIED,
+		},
+		{
+			name: "scope overrides parent", engine: documents, principal: alice, resource: cerbos.NewResource("document", "any").WithScope("acme"), action: "VIEW",
+			wantKind: enginev1.PlanResourcesFilter_KIND_CONDITIONAL, records: map[string]bool{"secret document": false, "public document": true, "untagged document": false},
+		},
+		{
+			name: "deny rule", engine: documents, principal: alice, resource: cerbos.NewResource("document", "any"), action: "SHARE",
+			wantKind: enginev1.PlanResourcesFilter_KIND_CONDITIONAL,
+			// Records without an attribute that a deny rule checks are excluded.
+			records: map[string]bool{"final document": true, "draft document": false, "undated document": false, "untagged document": false},
+		},
+		{
+			name: "scope adds rule", engine: documents, principal: alice, resource: cerbos.NewResource("document", "any").WithScope("acme"), action: "EDIT",
+			wantKind: enginev1.PlanResourcesFilter_KIND_ALWAYS_ALLOWED,
+		},
+		{
+			name: "missing scope", engine: documents, principal: alice, resource: cerbos.NewResource("document", "any").WithScope("acme.hr"), action: "VIEW",
+			wantKind: enginev1.PlanResourcesFilter_KIND_ALWAYS_DENIED,
+		},
+		{
+			name: "version", engine: documents, principal: alice, resource: cerbos.NewResource("document", "any").WithPolicyVersion("v2"), action: "DELETE",
+			wantKind: enginev1.PlanResourcesFilter_KIND_ALWAYS_ALLOWED,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			filter, err := tc.engine.Plan(tc.principal.Obj, tc.resource.Obj, tc.action)
+			if err != nil {
+				t.Fatalf("Plan failed: %v", err)
+			}
+
+			if filter.GetKind() != tc.wantKind {
+				t.Fatalf("Expected %s, got %s", tc.wantKind, filter.GetKind())
+			}
+
+			pred, err := queryplan.Compile(filter)
+			if err != nil {
+				t.Fatalf("Compile failed: %v", err)
+			}
+
+			for name, want := range tc.records {
+				attrs := records[name]
+				if got := pred(queryplan.AccessorFunc(func(attr string) (any, bool) {
+					v, ok := attrs[attr]
+					return v, ok
+				})); got != want {
+					t.Errorf("Expected %s to match %t, got %t", name, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadRejectsAuxData(t *testing.T) {
+	testCases := []struct {
+		name    string
+		expr    string
+		wantErr bool
+	}{
+		{name: "field", expr: `request.aux_data.jwt.iss == "demo-rest"`, wantErr: true},
+		{name: "index", expr: `request["aux_data"]["jwt"]["iss"] == "demo-rest"`, wantErr: true},
+		{name: "has", expr: `has(request.aux_data.jwt.sub)`, wantErr: true},
+		{name: "comprehension", expr: `["demo-rest"].exists(a, a in request.aux_data.jwt.aud)`, wantErr: true},
+		{name: "resource attribute", expr: `R.attr.aux_data == true`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			policy := `---
+apiVersion: api.cerbos.dev/v1
+resourcePolicy:
+  version: default
+  resource: document
+  rules:
+    - actions: ["VIEW"]
+      roles: ["user"]
+      effect: EFFECT_ALLOW
+      condition:
+        match:
+          expr: ` + "'" + tc.expr + "'\n"
+			if err := os.WriteFile(filepath.Join(dir, "document.yaml"), []byte(policy), 0o600); err != nil {
+				t.Fatalf("Failed to write policy: %v", err)
+			}
+
+			_, err := localpdp.Load(dir)
+			if tc.wantErr && !errors.Is(err, localpdp.ErrUnsupported) {
+				t.Errorf("Expected ErrUnsupported, got %v", err)
+			}
+			if !tc.wantErr && err != nil {
+				t.Errorf("Failed to load policy: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,345 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package localpdp
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	effectv1 "github.com/cerbos/cerbos/api/genpb/cerbos/effect/v1"
+	enginev1 "github.com/cerbos/cerbos/api/genpb/cerbos/engine/v1"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/interpreter"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// resourceAttrVar is the name used for resource attributes in query plans.
+const resourceAttrVar = "request.resource.attr"
+
+type operand = enginev1.PlanResourcesFilter_Expression_Operand
+
+// operators maps CEL functions to the operators used in query plans.
+var operators = map[string]string{
+	"_==_": "eq",
+	"_!=_": "ne",
+	"_<_":  "lt",
+	"_<=_": "le",
+	"_>_":  "gt",
+	"_>=_": "ge",
+	"_&&_": "and",
+	"_||_": "or",
+	"!_":   "not",
+	"@in":  "in",
+	"size": "size",
+}
+
+// Plan returns a filter that matches the resources of the given kind, policy version and scope on which the principal
+// can perform the action, in the same form as the filters produced by the Cerbos PlanResources API.
+// The attributes of the resource are ignored.
+func (e *Engine) Plan(principal *enginev1.Principal, resource *enginev1.Resource, action string) (*enginev1.PlanResourcesFilter, error) {
+	policies := e.policies(resource)
+	if len(policies) == 0 {
+		return &enginev1.PlanResourcesFilter{Kind: enginev1.PlanResourcesFilter_KIND_ALWAYS_DENIED}, nil
+	}
+
+	vars, err := cel.PartialVars(activation(principal, &enginev1.Resource{Kind: resource.GetKind()}),
+		cel.AttributePattern("R").QualString("attr"),
+		cel.AttributePattern("request").QualString("resource").QualString("attr"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each scope decides the resources that its rules match and leaves the rest to its parent,
+	// so the condition is built from the root scope down.
+	cond := boolValue(false)
+	for _, p := range slices.Backward(policies) {
+		allow, deny, err := e.planRules(p, principal, vars, action)
+		if err != nil {
+			return nil, err
+		}
+
+		matched := or(append(slices.Clone(allow), deny...)...)
+		cond = or(and(or(allow...), not(or(deny...))), and(not(matched), cond))
+	}
+
+	if b, ok := constBool(cond); ok {
+		if b {
+			return &enginev1.PlanResourcesFilter{Kind: enginev1.PlanResourcesFilter_KIND_ALWAYS_ALLOWED}, nil
+		}
+		return &enginev1.PlanResourcesFilter{Kind: enginev1.PlanResourcesFilter_KIND_ALWAYS_DENIED}, nil
+	}
+
+	return &enginev1.PlanResourcesFilter{Kind: enginev1.PlanResourcesFilter_KIND_CONDITIONAL, Condition: cond}, nil
+}
+
+// planRules returns the conditions under which each of the rules of the policy that allow or deny the action applies.
+func (e *Engine) planRules(p *resourcePolicy, principal *enginev1.Principal, vars interpreter.PartialActivation, action string) (allow, deny []*operand, err error) {
+	derivedRoles := make(map[string]*operand, len(p.derivedRoles))
+	for _, dr := range p.derivedRoles {
+		if !hasRole(principal.GetRoles(), dr.parentRoles) {
+			continue
+		}
+
+		cond, err := e.residual(dr.condition, vars)
+		if err != nil {
+			return nil, nil, fmt.Errorf("derived role %q: %w", dr.name, err)
+		}
+		derivedRoles[dr.name] = cond
+	}
+
+	for _, r := range p.rules {
+		if !r.matchesAction(action) {
+			continue
+		}
+
+		roleMatch := []*operand{boolValue(hasRole(principal.GetRoles(), r.roles))}
+		for _, name := range r.derivedRoles {
+			if cond, ok := derivedRoles[name]; ok {
+				roleMatch = append(roleMatch, cond)
+			}
+		}
+
+		cond, err := e.residual(r.condition, vars)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		applies := and(or(roleMatch...), cond)
+		if r.effect == effectv1.Effect_EFFECT_DENY {
+			deny = append(deny, applies)
+		} else {
+			allow = append(allow, applies)
+		}
+	}
+
+	return allow, deny, nil
+}
+
+// residual evaluates the condition with the known attributes and returns what is left of it in terms of the resource attributes.
+func (e *Engine) residual(c *condition, vars interpreter.PartialActivation) (*operand, error) {
+	if c == nil {
+		return boolValue(true), nil
+	}
+
+	var children []*operand
+	for _, child := range c.children {
+		op, err := e.residual(child, vars)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, op)
+	}
+
+	switch c.op {
+	case matchAll:
+		return and(children...), nil
+	case matchAny:
+		return or(children...), nil
+	case matchNone:
+		return not(or(children...)), nil
+	}
+
+	out, details, err := c.partial.Eval(vars)
+	if err != nil {
+		return boolValue(false), nil
+	}
+
+	if !types.IsUnknown(out) {
+		b, ok := out.Value().(bool)
+		return boolValue(ok && b), nil
+	}
+
+	ast, err := e.env.ResidualAst(c.ast, details)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := cel.AstToParsedExpr(ast)
+	if err != nil {
+		return nil, err
+	}
+
+	return toOperand(parsed.GetExpr())
+}
+
+// toOperand converts a residual CEL expression to a query plan operand.
+func toOperand(expr *exprpb.Expr) (*operand, error) {
+	switch e := expr.GetExprKind().(type) {
+	case *exprpb.Expr_ConstExpr:
+		v, err := constValue(e.ConstExpr)
+		if err != nil {
+			return nil, err
+		}
+		return &operand{Node: &enginev1.PlanResourcesFilter_Expression_Operand_Value{Value: v}}, nil
+
+	case *exprpb.Expr_ListExpr:
+		values := make([]*structpb.Value, len(e.ListExpr.GetElements()))
+		for i, elem := range e.ListExpr.GetElements() {
+			c := elem.GetConstExpr()
+			if c == nil {
+				return nil, fmt.Errorf("%w: list elements must be constant", ErrUnsupported)
+			}
+
+			v, err := constValue(c)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+		return &operand{Node: &enginev1.PlanResourcesFilter_Expression_Operand_Value{Value: structpb.NewListValue(&structpb.ListValue{Values: values})}}, nil
+
+	case *exprpb.Expr_SelectExpr, *exprpb.Expr_IdentExpr:
+		name, err := variableName(expr)
+		if err != nil {
+			return nil, err
+		}
+		return &operand{Node: &enginev1.PlanResourcesFilter_Expression_Operand_Variable{Variable: name}}, nil
+
+	case *exprpb.Expr_CallExpr:
+		op, ok := operators[e.CallExpr.GetFunction()]
+		if !ok {
+			return nil, fmt.Errorf("%w: function %q in query plan", ErrUnsupported, e.CallExpr.GetFunction())
+		}
+
+		args := e.CallExpr.GetArgs()
+		if t := e.CallExpr.GetTarget(); t != nil {
+			args = append([]*exprpb.Expr{t}, args...)
+		}
+
+		operands := make([]*operand, len(args))
+		for i, arg := range args {
+			o, err := toOperand(arg)
+			if err != nil {
+				return nil, err
+			}
+			operands[i] = o
+		}
+
+		return expression(op, operands...), nil
+
+	default:
+		return nil, fmt.Errorf("%w: expression %T in query plan", ErrUnsupported, e)
+	}
+}
+
+// variableName returns the query plan name of a resource attribute referred to as R.attr.x or request.resource.attr.x.
+func variableName(expr *exprpb.Expr) (string, error) {
+	var path []string
+	for expr.GetSelectExpr() != nil {
+		path = append(path, expr.GetSelectExpr().GetField())
+		expr = expr.GetSelectExpr().GetOperand()
+	}
+
+	if expr.GetIdentExpr() == nil {
+		return "", fmt.Errorf("%w: expression in query plan variable", ErrUnsupported)
+	}
+	path = append(path, expr.GetIdentExpr().GetName())
+	slices.Reverse(path)
+
+	name := strings.Join(path, ".")
+	if rest, ok := strings.CutPrefix(name, "R.attr"); ok {
+		name = resourceAttrVar + rest
+	}
+
+	if !strings.HasPrefix(name, resourceAttrVar+".") {
+		return "", fmt.Errorf("%w: variable %q in query plan", ErrUnsupported, name)
+	}
+
+	return name, nil
+}
+
+func constValue(c *exprpb.Constant) (*structpb.Value, error) {
+	switch k := c.GetConstantKind().(type) {
+	case *exprpb.Constant_BoolValue:
+		return structpb.NewBoolValue(k.BoolValue), nil
+	case *exprpb.Constant_StringValue:
+		return structpb.NewStringValue(k.StringValue), nil
+	case *exprpb.Constant_Int64Value:
+		return structpb.NewNumberValue(float64(k.Int64Value)), nil
+	case *exprpb.Constant_Uint64Value:
+		return structpb.NewNumberValue(float64(k.Uint64Value)), nil
+	case *exprpb.Constant_DoubleValue:
+		return structpb.NewNumberValue(k.DoubleValue), nil
+	case *exprpb.Constant_NullValue:
+		return structpb.NewNullValue(), nil
+	default:
+		return nil, fmt.Errorf("%w: constant %T in query plan", ErrUnsupported, k)
+	}
+}
+
+func boolValue(b bool) *operand {
+	return &operand{Node: &enginev1.PlanResourcesFilter_Expression_Operand_Value{Value: structpb.NewBoolValue(b)}}
+}
+
+// constBool returns the value of the operand if it is a boolean constant.
+func constBool(o *operand) (bool, bool) {
+	v, ok := o.GetValue().GetKind().(*structpb.Value_BoolValue)
+	if !ok {
+		return false, false
+	}
+	return v.BoolValue, true
+}
+
+func expression(op string, operands ...*operand) *operand {
+	return &operand{Node: &enginev1.PlanResourcesFilter_Expression_Operand_Expression{
+		Expression: &enginev1.PlanResourcesFilter_Expression{Operator: op, Operands: operands},
+	}}
+}
+
+// and combines the operands, dropping the ones that are always true. The result is false if any operand is always false.
+func and(operands ...*operand) *operand {
+	var rest []*operand
+	for _, o := range operands {
+		if b, ok := constBool(o); ok {
+			if !b {
+				return boolValue(false)
+			}
+			continue
+		}
+		rest = append(rest, o)
+	}
+
+	switch len(rest) {
+	case 0:
+		return boolValue(true)
+	case 1:
+		return rest[0]
+	default:
+		return expression("and", rest...)
+	}
+}
+
+// or combines the operands, dropping the ones that are always false. The result is true if any operand is always true.
+func or(operands ...*operand) *operand {
+	var rest []*operand
+	for _, o := range operands {
+		if b, ok := constBool(o); ok {
+			if b {
+				return boolValue(true)
+			}
+			continue
+		}
+		rest = append(rest, o)
+	}
+
+	switch len(rest) {
+	case 0:
+		return boolValue(false)
+	case 1:
+		return rest[0]
+	default:
+		return expression("or", rest...)
+	}
+}
+
+func not(o *operand) *operand {
+	if b, ok := constBool(o); ok {
+		return boolValue(!b)
+	}
+	return expression("not", o)
+}
@@ -0,0 +1,154 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package lockout tracks failed authentication attempts and throttles the clients that make too many of them.
+package lockout
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Config controls how quickly a key is throttled as failures accumulate.
+type Config struct {
+	// BackoffAfter is the number of consecutive failures allowed before the client has to wait between attempts.
+	BackoffAfter int
+	// BaseDelay is the wait imposed once BackoffAfter failures have been made. It doubles with every further failure.
+	BaseDelay time.Duration
+	// MaxDelay caps the wait imposed by the backoff.
+	MaxDelay time.Duration
+	// LockoutAfter is the number of consecutive failures after which the key is locked for LockoutDuration.
+	// Zero disables lockouts, leaving only the backoff.
+	LockoutAfter    int
+	LockoutDuration time.Duration
+	// ResetAfter is how long a key has to go without failures for its count to start again from zero.
+	ResetAfter time.Duration
+}
+
+var (
+	// DefaultAccountConfig is the default configuration for tracking failures by username.
+	DefaultAccountConfig = Config{
+		BackoffAfter:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		LockoutAfter:    5,
+		LockoutDuration: 15 * time.Minute,
+		ResetAfter:      15 * time.Minute,
+	}
+
+	// DefaultClientConfig is the default configuration for tracking failures by client IP address.
+	// Many users can share an address, so clients are only slowed down rather than locked out.
+	DefaultClientConfig = Config{
+		BackoffAfter: 20,
+		BaseDelay:    time.Second,
+		MaxDelay:     time.Minute,
+		ResetAfter:   15 * time.Minute,
+	}
+)
+
+// Tracker records failed attempts by key, such as a username or an IP address. Implementations must be safe for concurrent use.
+type Tracker interface {
+	// Blocked returns how long the client must wait before another attempt with the key is allowed. Zero means that it is allowed now.
+	Blocked(ctx context.Context, key string) (time.Duration, error)
+	// Fail records a failed attempt with the key and returns how long the client must now wait.
+	Fail(ctx context.Context, key string) (time.Duration, error)
+	// Reset forgets the failed attempts made with the key, lifting any lockout.
+	Reset(ctx context.Context, key string) error
+}
+
+type entry struct {
+	failures int
+	last     time.Time
+	until    time.Time
+}
+
+// Memory is an in-memory Tracker.
+type Memory struct {
+	mu        sync.Mutex
+	conf      Config
+	entries   map[string]*entry
+	lastSweep time.Time
+}
+
+var _ Tracker = (*Memory)(nil)
+
+func NewMemory(conf Config) *Memory {
+	return &Memory{conf: conf, entries: make(map[string]*entry), lastSweep: time.Now()}
+}
+
+func (m *Memory) Blocked(_ context.Context, key string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[key]
+	if !ok {
+		return 0, nil
+	}
+
+	return max(e.until.Sub(time.Now()), 0), nil
+}
+
+func (m *Memory) Fail(_ context.Context, key string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.sweep(now)
+
+	e, ok := m.entries[key]
+	if !ok || m.expired(e, now) {
+		e = &entry{}
+		m.entries[key] = e
+	}
+
+	e.failures++
+	e.last = now
+
+	switch {
+	case m.conf.LockoutAfter > 0 && e.failures >= m.conf.LockoutAfter:
+		e.until = now.Add(m.conf.LockoutDuration)
+	case e.failures >= m.conf.BackoffAfter:
+		e.until = now.Add(m.backoff(e.failures - m.conf.BackoffAfter))
+	}
+
+	return max(e.until.Sub(now), 0), nil
+}
+
+func (m *Memory) Reset(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.entries, key)
+
+	return nil
+}
+
+// backoff returns the delay after the given number of failures beyond BackoffAfter.
+func (m *Memory) backoff(n int) time.Duration {
+	delay := m.conf.BaseDelay
+	for i := 0; i < n && delay < m.conf.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	return min(delay, m.conf.MaxDelay)
+}
+
+// expired reports whether the entry is no longer blocked and has gone long enough without failures to be forgotten.
+func (m *Memory) expired(e *entry, now time.Time) bool {
+	return !now.Before(e.until) && now.Sub(e.last) >= m.conf.ResetAfter
+}
+
+// sweep removes expired entries so that attempts with many different keys do not grow the map indefinitely.
+func (m *Memory) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < m.conf.ResetAfter {
+		return
+	}
+
+	for key, e := range m.entries {
+		if m.expired(e, now) {
+			delete(m.entries, key)
+		}
+	}
+	m.lastSweep = now
+}
@@ -6,12 +6,19 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 
+	"github.com/cerbos/demo-rest/audit"
+	"github.com/cerbos/demo-rest/db"
+	"github.com/cerbos/demo-rest/localpdp"
+	"github.com/cerbos/demo-rest/lockout"
 	"github.com/cerbos/demo-rest/service"
 )
 
@@ -19,11 +26,194 @@ func main() {
 	listenAddr := flag.String("listen", ":9999", "Address to listen on")
 	certFile := flag.String("tlscert", "", "TLS certificate")
 	keyFile := flag.String("tlskey", "", "TLS Key")
+	clientCAFile := flag.String("tlsclientca", "", "CA certificates used to verify client certificates (client certificates are not requested if empty)")
+	clientAuth := flag.String("tlsclientauth", "require", "Whether client certificates are required (require) or only verified if presented (optional)")
+	clientCertUser := flag.String("tlsclientuser", "cn", "Client certificate field that names the user (cn, dns or email)")
 	cerbosAddr := flag.String("cerbos", "localhost:3593", "Address of the Cerbos server")
+	cerbosTLS := flag.Bool("cerbostls", false, "Connect to Cerbos over TLS (implied by the other -cerbos TLS options)")
+	cerbosCACert := flag.String("cerboscacert", "", "CA certificate used to verify the Cerbos server (the system roots are used if empty)")
+	cerbosClientCert := flag.String("cerbosclientcert", "", "Client certificate presented to the Cerbos server")
+	cerbosClientKey := flag.String("cerbosclientkey", "", "Key of the client certificate presented to the Cerbos server")
+	cerbosServerName := flag.String("cerbosservername", "", "Name used to verify the certificate of the Cerbos server if it differs from the address")
+	cerbosTimeout := flag.Duration("cerbostimeout", service.DefaultCerbosConfig.Timeout, "Timeout of each call to Cerbos, including retries (0 for no timeout)")
+	cerbosRetries := flag.Uint("cerbosretries", service.DefaultCerbosConfig.MaxRetries, "Number of times a call to Cerbos that failed with a transient error is retried")
+	cerbosFailMode := flag.String("cerbosfailmode", string(service.DefaultCerbosConfig.FailMode), "What to do when Cerbos is unreachable: reject every request (closed) or allow reading orders and inventory items (open-reads)")
+	pdpMode := flag.String("pdp", "remote", "Where policies are evaluated: by the Cerbos server (remote), in-process (local) or in-process only when Cerbos is unavailable (fallback)")
+	policyDir := flag.String("policies", "cerbos/policies", "Directory containing the policies evaluated in-process when -pdp is local or fallback")
+	decisionCacheTTL := flag.Duration("decisioncachettl", service.DefaultDecisionCacheConfig.TTL, "How long authorization decisions are cached (0 to disable)")
+	decisionCacheSize := flag.Int("decisioncachesize", service.DefaultDecisionCacheConfig.MaxEntries, "Number of authorization decisions to keep in the cache")
+	decisionCacheBypass := flag.Bool("decisioncachebypass", service.DefaultDecisionCacheConfig.BypassMutations, "Only cache the decisions of actions that do not change anything")
+	shadowVersion := flag.String("shadowversion", "", "Policy version to evaluate every check against in the background, reporting decisions that differ")
+	shadowScope := flag.String("shadowscope", "", "Policy scope to evaluate every check against in the background, reporting decisions that differ")
+	shadowKinds := flag.String("shadowkinds", "", "Comma-separated resource kinds to evaluate against the shadow policies (all kinds if empty)")
+	dbPath := flag.String("db", "", "Path to a SQLite database file (data is kept in memory if empty)")
+	auditLogPath := flag.String("auditlog", "", "Path to a file to append authorization decisions to as JSON lines")
+	jwtAlg := flag.String("jwtalg", "HS256", "Algorithm used to sign bearer tokens (HS256 or ES256)")
+	jwtKeyFile := flag.String("jwtkey", "", "File containing the HS256 secret or the PEM encoded ES256 private key used to sign bearer tokens (a random key is generated if empty)")
+	jwtTTL := flag.Duration("jwtttl", time.Hour, "Lifetime of bearer tokens")
+	lockoutAfter := flag.Int("lockoutafter", lockout.DefaultAccountConfig.LockoutAfter, "Number of consecutive failed logins after which an account is locked (0 to disable)")
+	lockoutDuration := flag.Duration("lockoutduration", lockout.DefaultAccountConfig.LockoutDuration, "How long an account stays locked after too many failed logins")
+	credCacheTTL := flag.Duration("credcachettl", time.Minute, "How long successful password verifications are cached (0 to disable)")
+	debug := flag.Bool("debug", false, "Enable endpoints for troubleshooting policies")
+	auditBufferSize := flag.Int("auditbuffer", 1000, "Number of authorization decisions to keep in memory for the audit endpoint")
 	flag.Parse()
 
+	// Create the storage backends
+	stores := service.InMemoryStores()
+	if *dbPath != "" {
+		sqlDB, err := db.OpenSQLite(context.Background(), *dbPath)
+		if err != nil {
+			log.Fatalf("Failed to open database: %v", err)
+		}
+		defer sqlDB.Close()
+
+		stores = service.Stores{Orders: sqlDB.Orders(), Inventory: sqlDB.Inventory(), Users: sqlDB.Users(), APIKeys: sqlDB.APIKeys()}
+	}
+	db.DefaultUserStore = stores.Users
+
+	// Create the audit log
+	opts := []service.Option{service.WithAuditBufferSize(*auditBufferSize)}
+	if *auditLogPath != "" {
+		auditLog, err := audit.NewFileSink(*auditLogPath)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		defer auditLog.Close()
+
+		opts = append(opts, service.WithAuditSink(auditLog))
+	}
+
+	// Create the bearer token issuer
+	var jwtKey []byte
+	if *jwtKeyFile != "" {
+		k, err := os.ReadFile(*jwtKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to read JWT key: %v", err)
+		}
+		jwtKey = k
+	} else {
+		log.Printf("WARNING: Using a random JWT key. Bearer tokens will not be valid after a restart")
+	}
+
+	tokens, err := service.NewTokenIssuer(*jwtAlg, jwtKey, *jwtTTL)
+	if err != nil {
+		log.Fatalf("Failed to create token issuer: %v", err)
+	}
+	opts = append(opts, service.WithTokenIssuer(tokens))
+
+	// Configure the connection to Cerbos
+	failMode, err := service.ParseFailMode(*cerbosFailMode)
+	if err != nil {
+		log.Fatalf("Invalid Cerbos fail mode: %v", err)
+	}
+
+	useTLS := *cerbosTLS || *cerbosCACert != "" || *cerbosClientCert != "" || *cerbosServerName != ""
+	opts = append(opts, service.WithCerbosConfig(service.CerbosConfig{
+		Plaintext:  !useTLS,
+		CACert:     *cerbosCACert,
+		ClientCert: *cerbosClientCert,
+		ClientKey:  *cerbosClientKey,
+		ServerName: *cerbosServerName,
+		Timeout:    *cerbosTimeout,
+		MaxRetries: *cerbosRetries,
+		FailMode:   failMode,
+	}))
+	if failMode == service.FailOpenReads {
+		log.Printf("WARNING: Orders and inventory items can be viewed without authorization while Cerbos is unreachable")
+	}
+
+	// Evaluate policies in-process if requested
+	switch *pdpMode {
+	case "remote":
+	case "local", "fallback":
+		engine, err := localpdp.Load(*policyDir)
+		if err != nil {
+			log.Fatalf("Failed to load policies: %v", err)
+		}
+
+		if *pdpMode == "local" {
+			log.Printf("WARNING: Evaluating policies in-process instead of using Cerbos")
+			opts = append(opts, service.WithLocalPolicies(engine))
+		} else {
+			opts = append(opts, service.WithLocalFallback(engine))
+		}
+	default:
+		log.Fatalf("Invalid PDP mode %q", *pdpMode)
+	}
+
+	// Compare decisions with the shadow policies
+	if *shadowVersion != "" || *shadowScope != "" {
+		if *pdpMode == "local" {
+			log.Fatalf("Shadow evaluation needs the Cerbos PDP and cannot be used with -pdp=local")
+		}
+
+		conf := service.ShadowConfig{PolicyVersion: *shadowVersion, Scope: *shadowScope}
+		if *shadowKinds != "" {
+			conf.ResourceKinds = strings.Split(*shadowKinds, ",")
+		}
+		opts = append(opts, service.WithShadowEvaluation(conf))
+	}
+
+	// Cache authorization decisions
+	if *decisionCacheTTL > 0 {
+		opts = append(opts, service.WithDecisionCache(service.DecisionCacheConfig{
+			TTL:             *decisionCacheTTL,
+			MaxEntries:      *decisionCacheSize,
+			BypassMutations: *decisionCacheBypass,
+		}))
+	}
+
+	// Throttle failed logins
+	accountConf := lockout.DefaultAccountConfig
+	accountConf.LockoutAfter = *lockoutAfter
+	accountConf.LockoutDuration = *lockoutDuration
+	opts = append(opts, service.WithLoginThrottling(lockout.NewMemory(accountConf), lockout.NewMemory(lockout.DefaultClientConfig)))
+
+	if *credCacheTTL > 0 {
+		opts = append(opts, service.WithCredentialCache(*credCacheTTL))
+	}
+
+	// Authenticate clients with certificates
+	var clientCAs *x509.CertPool
+	clientAuthType := tls.NoClientCert
+	if *clientCAFile != "" {
+		if *certFile == "" || *keyFile == "" {
+			log.Fatalf("Client certificates can only be used when TLS is enabled")
+		}
+
+		pem, err := os.ReadFile(*clientCAFile)
+		if err != nil {
+			log.Fatalf("Failed to read client CA: %v", err)
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certificates found in client CA file %s", *clientCAFile)
+		}
+
+		switch *clientAuth {
+		case "require":
+			clientAuthType = tls.RequireAndVerifyClientCert
+		case "optional":
+			clientAuthType = tls.VerifyClientCertIfGiven
+		default:
+			log.Fatalf("Invalid client certificate mode %q", *clientAuth)
+		}
+
+		field, err := service.ParseCertUserField(*clientCertUser)
+		if err != nil {
+			log.Fatalf("Invalid client certificate user field: %v", err)
+		}
+		opts = append(opts, service.WithClientCertAuth(field))
+	}
+
+	if *debug {
+		log.Printf("WARNING: Debug endpoints are enabled")
+		opts = append(opts, service.WithDebug())
+	}
+
 	// Create the service
-	svc, err := service.New(*cerbosAddr)
+	svc, err := service.New(*cerbosAddr, stores, opts...)
 	if err != nil {
 		log.Fatalf("Failed to create service: %v", err)
 	}
@@ -40,6 +230,8 @@ func main() {
 			MinVersion:               tls.VersionTLS13,
 			PreferServerCipherSuites: true,
 			NextProtos:               []string{"h2"},
+			ClientAuth:               clientAuthType,
+			ClientCAs:                clientCAs,
 		}
 
 		go func() {
@@ -0,0 +1,337 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package queryplan evaluates the filters produced by the Cerbos PlanResources API against in-memory records.
+package queryplan
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	enginev1 "github.com/cerbos/cerbos/api/genpb/cerbos/engine/v1"
+)
+
+// ResourceAttrPrefix is the prefix of the variables that refer to resource attributes in a query plan.
+const ResourceAttrPrefix = "request.resource.attr."
+
+var (
+	// ErrUnsupportedOperator is returned when the query plan contains an operator that cannot be evaluated.
+	ErrUnsupportedOperator = errors.New("unsupported operator")
+	// ErrInvalidPlan is returned when the query plan is malformed or refers to unknown variables.
+	ErrInvalidPlan = errors.New("invalid query plan")
+)
+
+// Accessor provides access to the attributes of a record by the names used in Cerbos resource attributes.
+type Accessor interface {
+	Attr(name string) (any, bool)
+}
+
+// AccessorFunc is an adapter to allow the use of ordinary functions as an Accessor.
+type AccessorFunc func(name string) (any, bool)
+
+func (f AccessorFunc) Attr(name string) (any, bool) {
+	return f(name)
+}
+
+// Predicate reports whether a record matches a query plan.
+type Predicate func(Accessor) bool
+
+// evaluator produces the value of a query plan operand for a record.
+// The boolean result is false if the value could not be determined, and records whose plan cannot be determined
+// never match.
+type evaluator func(Accessor) (any, bool)
+
+// Compile converts a PlanResources filter into a predicate.
+func Compile(filter *enginev1.PlanResourcesFilter) (Predicate, error) {
+	switch filter.GetKind() {
+	case enginev1.PlanResourcesFilter_KIND_ALWAYS_ALLOWED:
+		return func(Accessor) bool { return true }, nil
+	case enginev1.PlanResourcesFilter_KIND_ALWAYS_DENIED:
+		return func(Accessor) bool { return false }, nil
+	case enginev1.PlanResourcesFilter_KIND_CONDITIONAL:
+		eval, err := compileOperand(filter.GetCondition())
+		if err != nil {
+			return nil, err
+		}
+
+		return func(a Accessor) bool {
+			v, ok := eval(a)
+			b, isBool := v.(bool)
+			return ok && isBool && b
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: filter kind %s", ErrInvalidPlan, filter.GetKind())
+	}
+}
+
+func compileOperand(op *enginev1.PlanResourcesFilter_Expression_Operand) (evaluator, error) {
+	switch node := op.GetNode().(type) {
+	case *enginev1.PlanResourcesFilter_Expression_Operand_Value:
+		v := Normalize(node.Value.AsInterface())
+		return func(Accessor) (any, bool) { return v, true }, nil
+
+	case *enginev1.PlanResourcesFilter_Expression_Operand_Variable:
+		name, ok := strings.CutPrefix(node.Variable, ResourceAttrPrefix)
+		if !ok {
+			return nil, fmt.Errorf("%w: unsupported variable %q", ErrInvalidPlan, node.Variable)
+		}
+
+		return func(a Accessor) (any, bool) {
+			v, ok := a.Attr(name)
+			return Normalize(v), ok
+		}, nil
+
+	case *enginev1.PlanResourcesFilter_Expression_Operand_Expression:
+		return compileExpression(node.Expression)
+
+	default:
+		return nil, fmt.Errorf("%w: empty operand", ErrInvalidPlan)
+	}
+}
+
+func compileExpression(expr *enginev1.PlanResourcesFilter_Expression) (evaluator, error) {
+	operands := make([]evaluator, len(expr.GetOperands()))
+	for i, o := range expr.GetOperands() {
+		eval, err := compileOperand(o)
+		if err != nil {
+			return nil, err
+		}
+		operands[i] = eval
+	}
+
+	arity := func(n int) error {
+		if len(operands) != n {
+			return fmt.Errorf("%w: %s expects %d operands, got %d", ErrInvalidPlan, expr.GetOperator(), n, len(operands))
+		}
+		return nil
+	}
+
+	switch op := expr.GetOperator(); op {
+	// An operand that cannot be evaluated leaves the result of and/or undetermined unless another operand settles it,
+	// so that negating the result cannot match records that lack an attribute.
+	case "and":
+		return func(a Accessor) (any, bool) {
+			known := true
+			for _, eval := range operands {
+				b, ok := evalBool(eval, a)
+				if !ok {
+					known = false
+					continue
+				}
+				if !b {
+					return false, true
+				}
+			}
+			return known, known
+		}, nil
+
+	case "or":
+		return func(a Accessor) (any, bool) {
+			known := true
+			for _, eval := range operands {
+				b, ok := evalBool(eval, a)
+				if !ok {
+					known = false
+					continue
+				}
+				if b {
+					return true, true
+				}
+			}
+			return false, known
+		}, nil
+
+	case "not":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+
+		return func(a Accessor) (any, bool) {
+			b, ok := evalBool(operands[0], a)
+			return !b, ok
+		}, nil
+
+	case "eq", "ne":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+
+		want := op == "eq"
+		return func(a Accessor) (any, bool) {
+			l, lok := operands[0](a)
+			r, rok := operands[1](a)
+			if !lok || !rok {
+				return false, false
+			}
+			return reflect.DeepEqual(l, r) == want, true
+		}, nil
+
+	case "lt", "le", "gt", "ge":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+
+		return func(a Accessor) (any, bool) {
+			l, lok := operands[0](a)
+			r, rok := operands[1](a)
+			if !lok || !rok {
+				return false, false
+			}
+
+			c, ok := compare(l, r)
+			if !ok {
+				return false, false
+			}
+
+			switch op {
+			case "lt":
+				return c < 0, true
+			case "le":
+				return c <= 0, true
+			case "gt":
+				return c > 0, true
+			default:
+				return c >= 0, true
+			}
+		}, nil
+
+	case "in":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+
+		return func(a Accessor) (any, bool) {
+			needle, nok := operands[0](a)
+			haystack, hok := operands[1](a)
+			if !nok || !hok {
+				return false, false
+			}
+
+			switch h := haystack.(type) {
+			case []any:
+				for _, item := range h {
+					if reflect.DeepEqual(needle, item) {
+						return true, true
+					}
+				}
+				return false, true
+			case map[string]any:
+				key, ok := needle.(string)
+				if !ok {
+					return false, false
+				}
+				_, found := h[key]
+				return found, true
+			default:
+				return false, false
+			}
+		}, nil
+
+	case "size":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+
+		return func(a Accessor) (any, bool) {
+			v, ok := operands[0](a)
+			if !ok {
+				return nil, false
+			}
+
+			switch t := v.(type) {
+			case []any:
+				return float64(len(t)), true
+			case map[string]any:
+				return float64(len(t)), true
+			case string:
+				return float64(len(t)), true
+			default:
+				return nil, false
+			}
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedOperator, op)
+	}
+}
+
+func evalBool(eval evaluator, a Accessor) (bool, bool) {
+	v, ok := eval(a)
+	if !ok {
+		return false, false
+	}
+
+	b, ok := v.(bool)
+	return b, ok
+}
+
+// compare returns -1, 0 or 1 depending on the ordering of two numbers or two strings.
+func compare(l, r any) (int, bool) {
+	switch lv := l.(type) {
+	case float64:
+		rv, ok := r.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case lv < rv:
+			return -1, true
+		case lv > rv:
+			return 1, true
+		default:
+			return 0, true
+		}
+	case string:
+		rv, ok := r.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(lv, rv), true
+	default:
+		return 0, false
+	}
+}
+
+// Normalize converts a Go value to the representation used by protobuf Struct values
+// so that record attributes can be compared with the constants in a query plan.
+func Normalize(v any) any {
+	if v == nil {
+		return nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	case reflect.Bool:
+		return rv.Bool()
+	case reflect.Slice, reflect.Array:
+		out := make([]any, rv.Len())
+		for i := range out {
+			out[i] = Normalize(rv.Index(i).Interface())
+		}
+		return out
+	case reflect.Map:
+		out := make(map[string]any, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			out[fmt.Sprint(iter.Key().Interface())] = Normalize(iter.Value().Interface())
+		}
+		return out
+	case reflect.Pointer:
+		if rv.IsNil() {
+			return nil
+		}
+		return Normalize(rv.Elem().Interface())
+	default:
+		return v
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package queryplan_test
+
+import (
+	"errors"
+	"testing"
+
+	enginev1 "github.com/cerbos/cerbos/api/genpb/cerbos/engine/v1"
+	"github.com/cerbos/demo-rest/queryplan"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+type operand = enginev1.PlanResourcesFilter_Expression_Operand
+
+func value(v any) *operand {
+	pv, err := structpb.NewValue(v)
+	if err != nil {
+		panic(err)
+	}
+	return &operand{Node: &enginev1.PlanResourcesFilter_Expression_Operand_Value{Value: pv}}
+}
+
+func variable(name string) *operand {
+	return &operand{Node: &enginev1.PlanResourcesFilter_Expression_Operand_Variable{Variable: name}}
+}
+
+func attr(name string) *operand {
+	return variable(queryplan.ResourceAttrPrefix + name)
+}
+
+func expr(op string, operands ...*operand) *operand {
+	return &operand{Node: &enginev1.PlanResourcesFilter_Expression_Operand_Expression{
+		Expression: &enginev1.PlanResourcesFilter_Expression{Operator: op, Operands: operands},
+	}}
+}
+
+func conditional(cond *operand) *enginev1.PlanResourcesFilter {
+	return &enginev1.PlanResourcesFilter{Kind: enginev1.PlanResourcesFilter_KIND_CONDITIONAL, Condition: cond}
+}
+
+// record is shaped like the attributes of an order.
+var record = queryplan.AccessorFunc(func(name string) (any, bool) {
+	switch name {
+	case "owner":
+		return "adam", true
+	case "status":
+		return "PENDING", true
+	case "total":
+		return uint64(920), true
+	case "items":
+		return map[string]uint{"eggs": 24, "milk": 1}, true
+	case "aisles":
+		return []string{"dairy", "bakery"}, true
+	default:
+		return nil, false
+	}
+})
+
+func TestCompile(t *testing.T) {
+	testCases := []struct {
+		name   string
+		filter *enginev1.PlanResourcesFilter
+		want   bool
+	}{
+		{name: "always allowed", filter: &enginev1.PlanResourcesFilter{Kind: enginev1.PlanResourcesFilter_KIND_ALWAYS_ALLOWED}, want: true},
+		{name: "always denied", filter: &enginev1.PlanResourcesFilter{Kind: enginev1.PlanResourcesFilter_KIND_ALWAYS_DENIED}, want: false},
+		{name: "eq match", filter: conditional(expr("eq", attr("owner"), value("adam"))), want: true},
+		{name: "eq mismatch", filter: conditional(expr("eq", attr("owner"), value("eve"))), want: false},
+		{name: "eq number", filter: conditional(expr("eq", attr("total"), value(920))), want: true},
+		{name: "ne match", filter: conditional(expr("ne", attr("owner"), value("eve"))), want: true},
+		{name: "ne mismatch", filter: conditional(expr("ne", attr("owner"), value("adam"))), want: false},
+		{name: "in list", filter: conditional(expr("in", attr("status"), value([]any{"PENDING", "PICKING"}))), want: true},
+		{name: "not in list", filter: conditional(expr("in", attr("status"), value([]any{"PICKED"}))), want: false},
+		{name: "in map keys", filter: conditional(expr("in", value("eggs"), attr("items"))), want: true},
+		{name: "not in map keys", filter: conditional(expr("in", value("bread"), attr("items"))), want: false},
+		{name: "in attribute list", filter: conditional(expr("in", value("bakery"), attr("aisles"))), want: true},
+		{
+			name:   "and all true",
+			filter: conditional(expr("and", expr("eq", attr("owner"), value("adam")), expr("eq", attr("status"), value("PENDING")))),
+			want:   true,
+		},
+		{
+			name:   "and one false",
+			filter: conditional(expr("and", expr("eq", attr("owner"), value("adam")), expr("eq", attr("status"), value("PICKED")))),
+			want:   false,
+		},
+		{
+			name:   "or one true",
+			filter: conditional(expr("or", expr("eq", attr("owner"), value("eve")), expr("eq", attr("status"), value("PENDING")))),
+			want:   true,
+		},
+		{
+			name:   "or all false",
+			filter: conditional(expr("or", expr("eq", attr("owner"), value("eve")), expr("eq", attr("status"), value("PICKED")))),
+			want:   false,
+		},
+		{name: "not false", filter: conditional(expr("not", expr("eq", attr("owner"), value("eve")))), want: true},
+		{name: "not true", filter: conditional(expr("not", expr("eq", attr("owner"), value("adam")))), want: false},
+		{name: "lt true", filter: conditional(expr("lt", attr("total"), value(1000))), want: true},
+		{name: "lt equal", filter: conditional(expr("lt", attr("total"), value(920))), want: false},
+		{name: "le equal", filter: conditional(expr("le", attr("total"), value(920))), want: true},
+		{name: "gt true", filter: conditional(expr("gt", attr("total"), value(500))), want: true},
+		{name: "gt false", filter: conditional(expr("gt", attr("total"), value(1000))), want: false},
+		{name: "ge equal", filter: conditional(expr("ge", attr("total"), value(920))), want: true},
+		{name: "gt strings", filter: conditional(expr("gt", attr("owner"), value("aaron"))), want: true},
+		{name: "gt mixed types", filter: conditional(expr("gt", attr("owner"), value(1))), want: false},
+		{name: "size of map", filter: conditional(expr("eq", expr("size", attr("items")), value(2))), want: true},
+		{name: "size of list", filter: conditional(expr("gt", expr("size", attr("aisles")), value(2))), want: false},
+		{name: "size of string", filter: conditional(expr("eq", expr("size", attr("owner")), value(4))), want: true},
+		// Conditions on attributes that the record does not have never match, even when negated.
+		{name: "unknown attribute eq", filter: conditional(expr("eq", attr("colour"), value("red"))), want: false},
+		{name: "unknown attribute ne", filter: conditional(expr("ne", attr("colour"), value("red"))), want: false},
+		{name: "unknown attribute not", filter: conditional(expr("not", expr("eq", attr("colour"), value("red")))), want: false},
+		{name: "unknown attribute size", filter: conditional(expr("eq", expr("size", attr("colour")), value(0))), want: false},
+		{
+			name:   "unknown attribute in or",
+			filter: conditional(expr("or", expr("eq", attr("colour"), value("red")), expr("eq", attr("owner"), value("adam")))),
+			want:   true,
+		},
+		{
+			name:   "unknown attribute in and",
+			filter: conditional(expr("and", expr("eq", attr("colour"), value("red")), expr("eq", attr("owner"), value("eve")))),
+			want:   false,
+		},
+		{
+			name:   "unknown attribute in negated and",
+			filter: conditional(expr("not", expr("and", expr("eq", attr("colour"), value("red")), expr("eq", attr("owner"), value("adam"))))),
+			want:   false,
+		},
+		{
+			name:   "false and in negated and",
+			filter: conditional(expr("not", expr("and", expr("eq", attr("colour"), value("red")), expr("eq", attr("owner"), value("eve"))))),
+			want:   true,
+		},
+		{name: "unknown attribute in negated or", filter: conditional(expr("not", expr("or", expr("eq", attr("colour"), value("red"))))), want: false},
+		{
+			name: "unknown attribute in deny rule",
+			// Allowed for the owner unless the order is flagged, as the local planner writes a deny rule.
+			filter: conditional(expr("and",
+				expr("eq", attr("owner"), value("adam")),
+				expr("not", expr("or", expr("and", value(true), expr("eq", attr("flagged"), value(true))))),
+			)),
+			want: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pred, err := queryplan.Compile(tc.filter)
+			if err != nil {
+				t.Fatalf("Compile failed: %v", err)
+			}
+
+			if got := pred(record); got != tc.want {
+				t.Errorf("Expected %t, got %t", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	testCases := []struct {
+		name    string
+		filter  *enginev1.PlanResourcesFilter
+		wantErr error
+	}{
+		{name: "unsupported operator", filter: conditional(expr("matches", attr("owner"), value("^a"))), wantErr: queryplan.ErrUnsupportedOperator},
+		{
+			name:    "unsupported nested operator",
+			filter:  conditional(expr("and", expr("eq", attr("owner"), value("adam")), expr("startsWith", attr("owner"), value("a")))),
+			wantErr: queryplan.ErrUnsupportedOperator,
+		},
+		{name: "principal variable", filter: conditional(expr("eq", variable("request.principal.id"), value("adam"))), wantErr: queryplan.ErrInvalidPlan},
+		{name: "wrong arity", filter: conditional(expr("eq", attr("owner"))), wantErr: queryplan.ErrInvalidPlan},
+		{name: "empty operand", filter: conditional(&operand{}), wantErr: queryplan.ErrInvalidPlan},
+		{name: "unspecified kind", filter: &enginev1.PlanResourcesFilter{}, wantErr: queryplan.ErrInvalidPlan},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := queryplan.Compile(tc.filter)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Expected %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cerbos/demo-rest/db"
+	"github.com/gorilla/mux"
+	"github.com/rs/xid"
+)
+
+const (
+	apiKeyHeader = "X-API-Key"
+	// apiKeyPrefix makes keys easy to recognise, for example by secret scanners.
+	apiKeyPrefix    = "drk_"
+	apiKeySecretLen = 32
+)
+
+var (
+	errInvalidAPIKey  = errors.New("invalid API key")
+	errAPIKeyExpired  = errors.New("API key has expired")
+	errAPIKeyNoRoles  = errors.New("API key has none of the roles of the user")
+	errAPIKeyNotFound = errors.New("API key not found")
+)
+
+// newAPIKey is the request body for minting an API key.
+type newAPIKey struct {
+	Name string `json:"name"`
+	// Roles defaults to all the roles of the user if omitted.
+	Roles     []string   `json:"roles"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// generateAPIKey creates a new key and returns the string to give to the client along with the hash of its secret.
+// The key is made of a public ID, used to look it up, and a random secret.
+func generateAPIKey() (id, key string, hash []byte, err error) {
+	secret := make([]byte, apiKeySecretLen)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", nil, err
+	}
+
+	id = xid.New().String()
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+
+	return id, apiKeyPrefix + id + "." + encoded, hashAPIKeySecret(encoded), nil
+}
+
+// hashAPIKeySecret hashes the secret part of an API key. Secrets are long and random,
+// so a fast hash is enough to make the stored keys useless to an attacker.
+func hashAPIKeySecret(secret string) []byte {
+	h := sha256.Sum256([]byte(secret))
+	return h[:]
+}
+
+// parseAPIKey splits an API key into its ID and secret.
+func parseAPIKey(key string) (id, secret string, ok bool) {
+	rest, ok := strings.CutPrefix(key, apiKeyPrefix)
+	if !ok {
+		return "", "", false
+	}
+
+	id, secret, ok = strings.Cut(rest, ".")
+	return id, secret, ok && id != "" && secret != ""
+}
+
+// buildAPIKeyAuthContext verifies an API key and returns a new authContext object for its owner,
+// restricted to the roles that the key is scoped to.
+func (s *Service) buildAPIKeyAuthContext(key string, r *http.Request) (*authContext, error) {
+	id, secret, ok := parseAPIKey(key)
+	if !ok {
+		return nil, errInvalidAPIKey
+	}
+
+	rec, err := s.apiKeys.GetAPIKey(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, errInvalidAPIKey
+		}
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare(rec.Hash, hashAPIKeySecret(secret)) != 1 {
+		return nil, errInvalidAPIKey
+	}
+
+	if rec.Expired(time.Now()) {
+		return nil, errAPIKeyExpired
+	}
+
+	user, err := s.users.LookupUser(r.Context(), rec.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Disabled {
+		return nil, errUserDisabled
+	}
+
+	// Roles that have been taken away from the user since the key was minted are not granted by the key either.
+	scoped := *user
+	scoped.Roles = slices.DeleteFunc(slices.Clone(rec.Roles), func(role string) bool { return !slices.Contains(user.Roles, role) })
+	if len(scoped.Roles) == 0 {
+		return nil, errAPIKeyNoRoles
+	}
+
+	return newAuthContext(&scoped, authMethodAPIKey, r), nil
+}
+
+func (s *Service) handleAPIKeyCreate(w http.ResponseWriter, r *http.Request) {
+	defer cleanup(r)
+
+	user, err := s.retrieveUser(r)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusBadRequest, "User not found")
+		return
+	}
+
+	var req newAPIKey
+	if err := readJSON(r.Body, &req); err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+
+	if req.Roles == nil {
+		req.Roles = user.Roles
+	}
+
+	if len(req.Roles) == 0 || slices.ContainsFunc(req.Roles, func(role string) bool { return !slices.Contains(user.Roles, role) }) {
+		writeMessage(w, http.StatusBadRequest, "API key roles must be a subset of the user's roles")
+		return
+	}
+
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		writeMessage(w, http.StatusBadRequest, "API key expiry must be in the future")
+		return
+	}
+
+	if !s.authorize(w, r, toUserResource(*user).WithAttr("keyRoles", req.Roles), "CREATE_API_KEY") {
+		return
+	}
+
+	id, key, hash, err := generateAPIKey()
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+
+	rec := db.APIKey{
+		ID:        id,
+		Username:  user.Username,
+		Name:      req.Name,
+		Roles:     req.Roles,
+		Hash:      hash,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: req.ExpiresAt,
+	}
+
+	if err := s.apiKeys.CreateAPIKey(r.Context(), rec); err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+
+	// The key itself is only ever returned here. Only its hash is stored.
+	writeJSON(w, http.StatusCreated, struct {
+		db.APIKey
+		Key string `json:"key"`
+	}{APIKey: rec, Key: key})
+}
+
+func (s *Service) handleAPIKeyList(w http.ResponseWriter, r *http.Request) {
+	defer cleanup(r)
+
+	user, err := s.retrieveUser(r)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusBadRequest, "User not found")
+		return
+	}
+
+	if !s.authorize(w, r, toUserResource(*user), "VIEW_API_KEYS") {
+		return
+	}
+
+	keys, err := s.apiKeys.ListAPIKeys(r.Context(), user.Username)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to list API keys")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Keys []db.APIKey `json:"keys"`
+	}{Keys: keys})
+}
+
+func (s *Service) handleAPIKeyRevoke(w http.ResponseWriter, r *http.Request) {
+	defer cleanup(r)
+
+	user, err := s.retrieveUser(r)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusBadRequest, "User not found")
+		return
+	}
+
+	key, err := s.apiKeys.GetAPIKey(r.Context(), mux.Vars(r)["keyID"])
+	if err == nil && key.Username != user.Username {
+		err = errAPIKeyNotFound
+	}
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusBadRequest, "API key not found")
+		return
+	}
+
+	if !s.authorize(w, r, toUserResource(*user), "REVOKE_API_KEY") {
+		return
+	}
+
+	if err := s.apiKeys.DeleteAPIKey(r.Context(), key.ID); err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to revoke API key")
+		return
+	}
+
+	writeMessage(w, http.StatusOK, "API key revoked")
+}
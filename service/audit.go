@@ -0,0 +1,96 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cerbos/cerbos-sdk-go/cerbos"
+	"github.com/cerbos/demo-rest/audit"
+	"github.com/cerbos/demo-rest/localpdp"
+)
+
+const (
+	auditLogResource = "audit_log"
+	// defaultAuditBufferSize is the number of decisions kept in memory for the /admin/audit endpoint.
+	defaultAuditBufferSize = 1000
+)
+
+// WithAuditSink sends every authorization decision to the given sink in addition to the in-memory audit buffer.
+func WithAuditSink(sink audit.Sink) Option {
+	return func(s *Service) {
+		s.auditSinks = append(s.auditSinks, sink)
+	}
+}
+
+// WithAuditBufferSize sets the number of decisions kept in memory for the /admin/audit endpoint.
+func WithAuditBufferSize(size int) Option {
+	return func(s *Service) {
+		s.auditBuffer = audit.NewRingBuffer(size)
+	}
+}
+
+// recordDecision sends the outcome of an authorization check to the audit sinks.
+func (s *Service) recordDecision(ctx context.Context, resource *cerbos.Resource, action string, allowed bool, callID string, latency time.Duration, err error) {
+	d := audit.Decision{
+		Timestamp:    time.Now().UTC(),
+		RequestID:    getRequestID(ctx),
+		ResourceKind: resource.Kind(),
+		ResourceID:   resource.ID(),
+		ResourceAttr: localpdp.AttrValues(resource.Obj.GetAttr()),
+		Action:       action,
+		Effect:       audit.EffectDeny,
+		CallID:       callID,
+		LatencyMs:    float64(latency.Microseconds()) / 1000,
+	}
+
+	if actx := getAuthContext(ctx); actx != nil {
+		d.PrincipalID = actx.principal.ID()
+		d.PrincipalRoles = actx.principal.Roles()
+	}
+
+	if allowed {
+		d.Effect = audit.EffectAllow
+	}
+
+	if err != nil {
+		d.Error = err.Error()
+	}
+
+	s.audit.Record(d)
+}
+
+func (s *Service) handleAuditQuery(w http.ResponseWriter, r *http.Request) {
+	defer cleanup(r)
+
+	if !s.authorize(w, r, cerbos.NewResource(auditLogResource, "decisions"), "VIEW") {
+		return
+	}
+
+	q := r.URL.Query()
+	filter := audit.Filter{
+		PrincipalID:  q.Get("user"),
+		ResourceKind: q.Get("resourceKind"),
+		ResourceID:   q.Get("resourceID"),
+		Effect:       q.Get("effect"),
+	}
+
+	if limit := q.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			log.Printf("ERROR: invalid limit %q: %v", limit, err)
+			writeMessage(w, http.StatusBadRequest, "Bad request")
+			return
+		}
+		filter.Limit = n
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Decisions []audit.Decision `json:"decisions"`
+	}{Decisions: s.auditBuffer.Query(filter)})
+}
@@ -0,0 +1,116 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/cerbos/cerbos-sdk-go/cerbos"
+)
+
+var errNoAuthContext = errors.New("auth context is missing")
+
+// Authorizer makes the authorization decisions for the service. Implementations must be safe for concurrent use.
+type Authorizer interface {
+	// IsAllowed checks whether the principal can perform the action on the resource.
+	IsAllowed(ctx context.Context, principal *cerbos.Principal, resource *cerbos.Resource, action string) (bool, error)
+	// CheckResources checks the actions on a batch of resources, which can be of different kinds.
+	CheckResources(ctx context.Context, principal *cerbos.Principal, batch *cerbos.ResourceBatch) (*cerbos.CheckResourcesResponse, error)
+	// PlanResources returns a query plan that filters the resources of a kind to those on which the principal can perform the action.
+	PlanResources(ctx context.Context, principal *cerbos.Principal, resource *cerbos.Resource, action string) (*cerbos.PlanResourcesResponse, error)
+}
+
+var (
+	_ Authorizer = grpcAuthorizer{}
+	_ Authorizer = localAuthorizer{}
+	_ Authorizer = fallbackAuthorizer{}
+)
+
+// WithAuthorizer makes the service use the given Authorizer instead of connecting to the Cerbos PDP.
+func WithAuthorizer(a Authorizer) Option {
+	return func(s *Service) {
+		s.authz = a
+	}
+}
+
+// grpcAuthorizer sends authorization requests to the Cerbos PDP. The bearer token used to authenticate the request,
+// if any, is forwarded as auxiliary data so that policies can refer to its claims through request.aux_data.jwt.
+type grpcAuthorizer struct {
+	client *cerbos.GRPCClient
+}
+
+func (a grpcAuthorizer) withAuxData(ctx context.Context) *cerbos.GRPCClient {
+	if actx := getAuthContext(ctx); actx != nil && actx.token != "" {
+		return a.client.With(cerbos.AuxDataJWT(actx.token, ""))
+	}
+
+	return a.client
+}
+
+func (a grpcAuthorizer) IsAllowed(ctx context.Context, principal *cerbos.Principal, resource *cerbos.Resource, action string) (bool, error) {
+	return a.withAuxData(ctx).IsAllowed(ctx, principal, resource, action)
+}
+
+func (a grpcAuthorizer) CheckResources(ctx context.Context, principal *cerbos.Principal, batch *cerbos.ResourceBatch) (*cerbos.CheckResourcesResponse, error) {
+	return a.withAuxData(ctx).CheckResources(ctx, principal, batch)
+}
+
+func (a grpcAuthorizer) PlanResources(ctx context.Context, principal *cerbos.Principal, resource *cerbos.Resource, action string) (*cerbos.PlanResourcesResponse, error) {
+	return a.withAuxData(ctx).PlanResources(ctx, principal, resource, action)
+}
+
+// fallbackAuthorizer sends requests to the primary Authorizer and to the fallback if the primary is unavailable.
+type fallbackAuthorizer struct {
+	primary  Authorizer
+	fallback Authorizer
+}
+
+func (a fallbackAuthorizer) IsAllowed(ctx context.Context, principal *cerbos.Principal, resource *cerbos.Resource, action string) (bool, error) {
+	allowed, err := a.primary.IsAllowed(ctx, principal, resource, action)
+	if fallBack(err) {
+		return a.fallback.IsAllowed(ctx, principal, resource, action)
+	}
+
+	return allowed, err
+}
+
+func (a fallbackAuthorizer) CheckResources(ctx context.Context, principal *cerbos.Principal, batch *cerbos.ResourceBatch) (*cerbos.CheckResourcesResponse, error) {
+	resp, err := a.primary.CheckResources(ctx, principal, batch)
+	if fallBack(err) {
+		return a.fallback.CheckResources(ctx, principal, batch)
+	}
+
+	return resp, err
+}
+
+func (a fallbackAuthorizer) PlanResources(ctx context.Context, principal *cerbos.Principal, resource *cerbos.Resource, action string) (*cerbos.PlanResourcesResponse, error) {
+	resp, err := a.primary.PlanResources(ctx, principal, resource, action)
+	if fallBack(err) {
+		return a.fallback.PlanResources(ctx, principal, resource, action)
+	}
+
+	return resp, err
+}
+
+// fallBack reports whether err shows that the PDP is unavailable, in which case the request is sent to the fallback.
+func fallBack(err error) bool {
+	if !errors.Is(cerbosError(err), errPDPUnavailable) {
+		return false
+	}
+
+	log.Printf("WARNING: Evaluating policies locally because Cerbos is unavailable: %v", err)
+	return true
+}
+
+// authPrincipal retrieves the principal stored in the context by the authentication middleware.
+func authPrincipal(ctx context.Context) (*cerbos.Principal, error) {
+	actx := getAuthContext(ctx)
+	if actx == nil {
+		return nil, errNoAuthContext
+	}
+
+	return actx.principal, nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/cerbos/demo-rest/db"
+)
+
+// maxBulkOrders is the maximum number of orders that can be updated in a single request.
+const maxBulkOrders = 500
+
+const (
+	bulkResultUpdated           = "updated"
+	bulkResultForbidden         = "forbidden"
+	bulkResultNotFound          = "not_found"
+	bulkResultInvalidTransition = "invalid_transition"
+	bulkResultConflict          = "conflict"
+	bulkResultFailed            = "failed"
+)
+
+// bulkStatusUpdate is the request body for updating the status of many orders at once.
+type bulkStatusUpdate struct {
+	OrderIDs []uint64 `json:"orderIDs"`
+	Status   string   `json:"status"`
+}
+
+// bulkStatusResult is the outcome of updating the status of a single order in a bulk update.
+type bulkStatusResult struct {
+	OrderID         uint64           `json:"orderID"`
+	Result          string           `json:"result"`
+	AllowedStatuses []db.OrderStatus `json:"allowedStatuses,omitempty"`
+}
+
+func (s *Service) handleBackofficeBulkOrderUpdate(w http.ResponseWriter, r *http.Request) {
+	defer cleanup(r)
+
+	var req bulkStatusUpdate
+	if err := readJSON(r.Body, &req); err != nil || len(req.OrderIDs) == 0 || len(req.OrderIDs) > maxBulkOrders {
+		log.Printf("ERROR: invalid bulk status update: %v", err)
+		writeMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+
+	// As for a single order, the status is only validated once the principal is allowed to update some of the orders.
+	status, statusErr := db.ParseOrderStatus(req.Status)
+
+	// Retrieve the orders and collect the checks for all of them, including the stock that has to be picked,
+	// so that they can be authorized in a single batch.
+	results := make([]bulkStatusResult, 0, len(req.OrderIDs))
+	orders := make(map[uint64]db.Order, len(req.OrderIDs))
+	seen := make(map[uint64]struct{}, len(req.OrderIDs))
+	picks := make(map[string]uint)
+	var checks []resourceCheck
+
+	for _, id := range req.OrderIDs {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		results = append(results, bulkStatusResult{OrderID: id})
+
+		order, err := s.orders.Get(r.Context(), id)
+		if err != nil {
+			if !errors.Is(err, db.ErrNotFound) {
+				log.Printf("ERROR: %v", err)
+				results[len(results)-1].Result = bulkResultFailed
+			}
+			continue
+		}
+
+		orders[id] = order
+		resource := toOrderResource(order).WithAttr("newStatus", req.Status)
+		checks = append(checks, resourceCheck{resource: resource, actions: []string{"UPDATE_STATUS"}})
+
+		if picksStock(order.Status, status) {
+			for item, qty := range order.Items {
+				picks[item] += qty
+			}
+		}
+	}
+
+	// Stock for the same item may be picked for several orders, so the principal must be allowed to pick the combined quantity.
+	pickChecks, err := s.pickChecks(r.Context(), picks)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to update order status")
+		return
+	}
+	checks = append(checks, pickChecks...)
+
+	authz, err := s.checkBatch(r.Context(), checks...)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		// Reject the whole request if the PDP is down or the request is not authenticated.
+		// Any other failure is treated as a denial of the whole batch: checkBatch denies every check if any of them fail.
+		if errors.Is(err, errPDPUnavailable) || errors.Is(err, errNoAuthContext) {
+			writeAuthzError(w, err, http.StatusForbidden, "Operation not allowed")
+			return
+		}
+	}
+
+	if statusErr != nil {
+		log.Printf("ERROR: %v", statusErr)
+		if !slices.ContainsFunc(checks, func(c resourceCheck) bool { return authz.allowed(c.resource, "UPDATE_STATUS") }) {
+			writeMessage(w, http.StatusForbidden, "Operation not allowed")
+			return
+		}
+		writeMessage(w, http.StatusUnprocessableEntity, "Invalid order status")
+		return
+	}
+
+	for i := range results {
+		if results[i].Result == "" {
+			results[i].Result, results[i].AllowedStatuses = s.applyBulkStatus(r.Context(), orders, authz, results[i].OrderID, status)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Results []bulkStatusResult `json:"results"`
+	}{Results: results})
+}
+
+// applyBulkStatus updates the status of a single order in a bulk update if it has been authorized
+// and returns the result along with the statuses that the order can move to if the transition is invalid.
+func (s *Service) applyBulkStatus(ctx context.Context, orders map[uint64]db.Order, d decisions, orderID uint64, status db.OrderStatus) (string, []db.OrderStatus) {
+	order, ok := orders[orderID]
+	if !ok {
+		return bulkResultNotFound, nil
+	}
+
+	if !d.allowed(toOrderResource(order), "UPDATE_STATUS") {
+		return bulkResultForbidden, nil
+	}
+
+	if picksStock(order.Status, status) {
+		for item := range order.Items {
+			// Items that are no longer in the inventory were not checked because there is nothing to pick.
+			if actions, checked := d[decisionKey{kind: inventoryResource, id: item}]; checked && !actions["PICK"] {
+				return bulkResultForbidden, nil
+			}
+		}
+	}
+
+	if err := s.orders.SetStatus(ctx, order.ID, status, s.adjustStock(order, status)); err != nil {
+		log.Printf("ERROR: %v", err)
+
+		var transitionErr *db.TransitionError
+		switch {
+		case errors.As(err, &transitionErr):
+			return bulkResultInvalidTransition, transitionErr.Allowed
+		case errors.Is(err, db.ErrNotFound):
+			return bulkResultNotFound, nil
+		case errors.Is(err, errOrderChanged):
+			return bulkResultConflict, nil
+		default:
+			return bulkResultFailed, nil
+		}
+	}
+
+	return bulkResultUpdated, nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/cerbos/cerbos-sdk-go/cerbos"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// FailMode decides what happens to a request when the Cerbos PDP cannot be reached.
+type FailMode string
+
+const (
+	// FailClosed rejects every request that needs an authorization decision.
+	FailClosed FailMode = "closed"
+	// FailOpenReads lets the reads listed in failOpenActions through and rejects everything else.
+	FailOpenReads FailMode = "open-reads"
+)
+
+// ParseFailMode returns the FailMode with the given name.
+func ParseFailMode(name string) (FailMode, error) {
+	switch m := FailMode(name); m {
+	case FailClosed, FailOpenReads:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown fail mode %q", name)
+	}
+}
+
+// failOpenActions are the actions, by resource kind, that are allowed when the PDP is unreachable in FailOpenReads mode.
+// Only views of single orders and inventory items are included. Admin resources and order history always fail closed
+// and lists cannot be filtered without a query plan from the PDP.
+var failOpenActions = map[string][]string{
+	orderResource:     {"VIEW"},
+	inventoryResource: {"VIEW"},
+}
+
+// employeeRole is the role of store staff, who can view every order and inventory item.
+const employeeRole = "employee"
+
+// errPDPUnavailable is wrapped by the errors returned when the PDP cannot be reached or does not respond in time.
+var errPDPUnavailable = errors.New("PDP is unavailable")
+
+// CerbosConfig configures the connection to the Cerbos PDP.
+type CerbosConfig struct {
+	// Plaintext connects without TLS. The other TLS settings are ignored if it is set.
+	Plaintext bool
+	// CACert is the path to the CA certificate used to verify the PDP. The system roots are used if it is empty.
+	CACert string
+	// ClientCert and ClientKey are the paths to the certificate and key presented to the PDP, if it requires them.
+	ClientCert string
+	ClientKey  string
+	// ServerName overrides the name used to verify the certificate of the PDP.
+	ServerName string
+	// Timeout bounds each call to the PDP, including retries. Zero means no timeout.
+	Timeout time.Duration
+	// MaxRetries is the number of times a call that failed with a transient error is retried.
+	MaxRetries uint
+	FailMode   FailMode
+}
+
+// DefaultCerbosConfig connects to the PDP without TLS and fails closed.
+var DefaultCerbosConfig = CerbosConfig{
+	Plaintext:  true,
+	Timeout:    2 * time.Second,
+	MaxRetries: 2,
+	FailMode:   FailClosed,
+}
+
+// WithCerbosConfig replaces DefaultCerbosConfig as the configuration of the connection to the PDP.
+func WithCerbosConfig(conf CerbosConfig) Option {
+	return func(s *Service) {
+		s.cerbosConf = conf
+	}
+}
+
+// newCerbosClient creates a client for the PDP at the given address.
+func newCerbosClient(addr string, conf CerbosConfig) (*cerbos.GRPCClient, error) {
+	var opts []cerbos.Opt
+	if conf.Plaintext {
+		opts = append(opts, cerbos.WithPlaintext())
+	} else {
+		if conf.CACert != "" {
+			opts = append(opts, cerbos.WithTLSCACert(conf.CACert))
+		}
+
+		if conf.ClientCert != "" || conf.ClientKey != "" {
+			opts = append(opts, cerbos.WithTLSClientCert(conf.ClientCert, conf.ClientKey))
+		}
+
+		if conf.ServerName != "" {
+			opts = append(opts, cerbos.WithTLSAuthority(conf.ServerName))
+		}
+	}
+
+	// Each attempt gets an equal share of the call timeout so that retries cannot extend the call.
+	opts = append(opts, cerbos.WithMaxRetries(conf.MaxRetries))
+	if conf.Timeout > 0 {
+		opts = append(opts, cerbos.WithRetryTimeout(conf.Timeout/time.Duration(conf.MaxRetries+1)))
+	}
+
+	return cerbos.New(addr, opts...)
+}
+
+// cerbosContext returns the context for a single call to the PDP, bounded by the configured timeout.
+func (s *Service) cerbosContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.cerbosConf.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, s.cerbosConf.Timeout)
+}
+
+// cerbosError wraps err with errPDPUnavailable if it shows that the PDP could not be reached or did not respond in time.
+func cerbosError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return fmt.Errorf("%w: %w", errPDPUnavailable, err)
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", errPDPUnavailable, err)
+	}
+
+	return err
+}
+
+// failsOpen reports whether the principal is allowed the action on the resource while the PDP is unreachable.
+func (s *Service) failsOpen(principal *cerbos.Principal, resource *cerbos.Resource, action string) bool {
+	if s.cerbosConf.FailMode != FailOpenReads || !slices.Contains(failOpenActions[resource.Kind()], action) {
+		return false
+	}
+
+	if slices.Contains(principal.Roles(), employeeRole) {
+		return true
+	}
+
+	// As in the order policy, customers can only view their own orders.
+	return resource.Kind() == orderResource && resource.Obj.GetAttr()["owner"].GetStringValue() == principal.ID()
+}
+
+// writeAuthzError writes a 503 response if err shows that the PDP is unavailable, a 500 response if the request
+// was not authenticated properly and a response with the given status and message otherwise.
+// Clients can tell an outage apart from a denial by the error field.
+func writeAuthzError(w http.ResponseWriter, err error, code int, msg string) {
+	if errors.Is(err, errNoAuthContext) {
+		writeMessage(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	if !errors.Is(err, errPDPUnavailable) {
+		writeMessage(w, code, msg)
+		return
+	}
+
+	writeJSON(w, http.StatusServiceUnavailable, struct {
+		Message string `json:"message"`
+		Error   string `json:"error"`
+	}{Message: "Authorization service unavailable", Error: "PDP_UNAVAILABLE"})
+}
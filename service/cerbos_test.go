@@ -0,0 +1,113 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/cerbos/demo-rest/db"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type errorResponse struct {
+	Message string `json:"message"`
+	Error   string `json:"error"`
+}
+
+func TestPDPUnavailable(t *testing.T) {
+	testCases := []struct {
+		name     string
+		failMode FailMode
+		user     string
+		method   string
+		path     string
+		body     any
+		wantCode int
+		// wantAllowed is checked if the request succeeds.
+		wantAllowed []string
+	}{
+		{name: "closed order view", failMode: FailClosed, user: "adam", method: http.MethodGet, path: "/store/order/1", wantCode: http.StatusServiceUnavailable},
+		{name: "closed inventory view", failMode: FailClosed, user: "bella", method: http.MethodGet, path: "/backoffice/inventory/eggs", wantCode: http.StatusServiceUnavailable},
+		{name: "closed order list", failMode: FailClosed, user: "adam", method: http.MethodGet, path: "/store/order", wantCode: http.StatusServiceUnavailable},
+		{
+			name: "open-reads own order view", failMode: FailOpenReads, user: "adam", method: http.MethodGet, path: "/store/order/1",
+			wantCode: http.StatusOK, wantAllowed: []string{"VIEW"},
+		},
+		{
+			name: "open-reads employee order view", failMode: FailOpenReads, user: "bella", method: http.MethodGet, path: "/store/order/1",
+			wantCode: http.StatusOK, wantAllowed: []string{"VIEW"},
+		},
+		{
+			name: "open-reads employee inventory view", failMode: FailOpenReads, user: "bella", method: http.MethodGet, path: "/backoffice/inventory/eggs",
+			wantCode: http.StatusOK, wantAllowed: []string{"VIEW"},
+		},
+		// Only the views that the policies allow to the principal fail open.
+		{name: "open-reads other customer's order view", failMode: FailOpenReads, user: "eve", method: http.MethodGet, path: "/store/order/1", wantCode: http.StatusServiceUnavailable},
+		{
+			name: "open-reads customer inventory view", failMode: FailOpenReads, user: "adam", method: http.MethodGet, path: "/backoffice/inventory/eggs",
+			wantCode: http.StatusServiceUnavailable,
+		},
+		// History, lists and writes always fail closed.
+		{name: "open-reads own order history", failMode: FailOpenReads, user: "adam", method: http.MethodGet, path: "/store/order/1/history", wantCode: http.StatusServiceUnavailable},
+		{
+			name: "open-reads other customer's order history", failMode: FailOpenReads, user: "eve", method: http.MethodGet, path: "/store/order/1/history",
+			wantCode: http.StatusServiceUnavailable,
+		},
+		{name: "open-reads order list", failMode: FailOpenReads, user: "adam", method: http.MethodGet, path: "/store/order", wantCode: http.StatusServiceUnavailable},
+		{
+			name: "open-reads order update", failMode: FailOpenReads, user: "adam", method: http.MethodPost, path: "/store/order/1",
+			body: db.CustomerOrder{Items: map[string]uint{"eggs": 6, "milk": 1}}, wantCode: http.StatusServiceUnavailable,
+		},
+		{name: "open-reads order delete", failMode: FailOpenReads, user: "adam", method: http.MethodDelete, path: "/store/order/1", wantCode: http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conf := DefaultCerbosConfig
+			conf.FailMode = tc.failMode
+			authz := NewFakeAuthorizer().Allow("*", "*", "*").Fail(status.Error(codes.Unavailable, "connection refused"))
+			s := newTestService(t, authz, WithCerbosConfig(conf))
+
+			ctx := context.Background()
+			for _, item := range []string{"eggs", "milk"} {
+				if err := s.inventory.Add(ctx, db.InventoryItem{ID: item, Aisle: "dairy", Price: 30}); err != nil {
+					t.Fatalf("Failed to add item: %v", err)
+				}
+			}
+			line, err := db.NewOrderLine("eggs", 12, 30)
+			if err != nil {
+				t.Fatalf("Failed to create order line: %v", err)
+			}
+			if _, err := s.orders.Create(ctx, "adam", []db.OrderLine{line}); err != nil {
+				t.Fatalf("Failed to create order: %v", err)
+			}
+
+			rec := do(t, s.Handler(), tc.user, tc.method, tc.path, tc.body)
+			if rec.Code != tc.wantCode {
+				t.Fatalf("Expected status %d, got %d: %s", tc.wantCode, rec.Code, rec.Body)
+			}
+
+			if tc.wantCode == http.StatusServiceUnavailable {
+				want := errorResponse{Message: "Authorization service unavailable", Error: "PDP_UNAVAILABLE"}
+				if got := decode[errorResponse](t, rec); got != want {
+					t.Errorf("Expected %+v, got %+v", want, got)
+				}
+				return
+			}
+
+			if tc.wantAllowed != nil {
+				resp := decode[struct {
+					AllowedActions []string `json:"_allowedActions"`
+				}](t, rec)
+				if !slices.Equal(resp.AllowedActions, tc.wantAllowed) {
+					t.Errorf("Expected allowed actions %v, got %v", tc.wantAllowed, resp.AllowedActions)
+				}
+			}
+		})
+	}
+}
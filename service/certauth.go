@@ -0,0 +1,110 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/cerbos/demo-rest/db"
+)
+
+// CertUserField is the field of a client certificate that names the user it was issued to.
+type CertUserField string
+
+const (
+	// CertUserCommonName maps the common name of the certificate subject to a user.
+	CertUserCommonName CertUserField = "cn"
+	// CertUserDNSName maps the DNS names in the subject alternative name extension to a user.
+	CertUserDNSName CertUserField = "dns"
+	// CertUserEmail maps the email addresses in the subject alternative name extension to a user.
+	CertUserEmail CertUserField = "email"
+)
+
+var errCertNoUser = errors.New("client certificate does not match any user")
+
+// ParseCertUserField returns the CertUserField with the given name.
+func ParseCertUserField(name string) (CertUserField, error) {
+	switch f := CertUserField(name); f {
+	case CertUserCommonName, CertUserDNSName, CertUserEmail:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown client certificate field %q", name)
+	}
+}
+
+// WithClientCertAuth enables authentication with client certificates, which must have been verified by the TLS server.
+// The user is looked up using the given field of the certificate.
+func WithClientCertAuth(field CertUserField) Option {
+	return func(s *Service) {
+		s.certUserField = field
+	}
+}
+
+// clientCert returns the verified client certificate of the request, if there is one.
+func clientCert(r *http.Request) (*x509.Certificate, bool) {
+	// The TLS server only builds verified chains for certificates signed by the client CA.
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+
+	return r.TLS.VerifiedChains[0][0], true
+}
+
+// certUsernames returns the candidate usernames in the given field of the certificate.
+func certUsernames(cert *x509.Certificate, field CertUserField) []string {
+	switch field {
+	case CertUserDNSName:
+		return cert.DNSNames
+	case CertUserEmail:
+		return cert.EmailAddresses
+	default:
+		if cert.Subject.CommonName == "" {
+			return nil
+		}
+		return []string{cert.Subject.CommonName}
+	}
+}
+
+// buildCertAuthContext returns a new authContext object for the user named by a verified client certificate.
+// The organizational units and serial number of the certificate are added to the principal attributes.
+func (s *Service) buildCertAuthContext(cert *x509.Certificate, r *http.Request) (*authContext, error) {
+	var record *db.UserRecord
+	for _, name := range certUsernames(cert, s.certUserField) {
+		rec, err := s.users.LookupUser(r.Context(), name)
+		if err == nil {
+			record = rec
+			break
+		}
+
+		if !errors.Is(err, db.ErrNotFound) {
+			return nil, err
+		}
+	}
+
+	if record == nil {
+		return nil, errCertNoUser
+	}
+
+	if record.Disabled {
+		return nil, errUserDisabled
+	}
+
+	// Nested attribute values must be built from untyped lists.
+	ous := make([]any, len(cert.Subject.OrganizationalUnit))
+	for i, ou := range cert.Subject.OrganizationalUnit {
+		ous[i] = ou
+	}
+
+	actx := newAuthContext(record, authMethodCert, r)
+	actx.principal = actx.principal.WithAttr("certificate", map[string]any{
+		"subject": cert.Subject.String(),
+		"ou":      ous,
+		"serial":  cert.SerialNumber.Text(16),
+	})
+
+	return actx, nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cerbos/demo-rest/db"
+)
+
+// newClientCert creates a self-signed client certificate from the template.
+func newClientCert(t *testing.T, template x509.Certificate) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	if template.SerialNumber == nil {
+		template.SerialNumber = big.NewInt(1)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+
+	return cert
+}
+
+// verified returns the connection state of a TLS server that has verified the client certificate.
+func verified(cert *x509.Certificate) *tls.ConnectionState {
+	return &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	harry := newClientCert(t, x509.Certificate{Subject: pkix.Name{CommonName: "harry"}})
+
+	testCases := []struct {
+		name  string
+		field CertUserField
+		tls   *tls.ConnectionState
+		// user and password are sent with Basic authentication if set.
+		user     string
+		password string
+		// wantUser is the authenticated principal. The request is expected to be rejected if it is empty.
+		wantUser string
+	}{
+		{name: "common name", field: CertUserCommonName, tls: verified(harry), wantUser: "harry"},
+		{
+			name: "DNS name", field: CertUserDNSName, wantUser: "charlie",
+			tls: verified(newClientCert(t, x509.Certificate{DNSNames: []string{"scanner.example.com", "charlie"}})),
+		},
+		{
+			name: "email", field: CertUserEmail, wantUser: "ivy@example.com",
+			tls: verified(newClientCert(t, x509.Certificate{Subject: pkix.Name{CommonName: "harry"}, EmailAddresses: []string{"ivy@example.com"}})),
+		},
+		{name: "field not in certificate", field: CertUserDNSName, tls: verified(harry)},
+		{name: "empty common name", field: CertUserCommonName, tls: verified(newClientCert(t, x509.Certificate{DNSNames: []string{"harry"}}))},
+		{name: "unknown user", field: CertUserCommonName, tls: verified(newClientCert(t, x509.Certificate{Subject: pkix.Name{CommonName: "zoe"}}))},
+		{name: "disabled user", field: CertUserCommonName, tls: verified(newClientCert(t, x509.Certificate{Subject: pkix.Name{CommonName: "jenny"}}))},
+		{name: "unverified certificate", field: CertUserCommonName, tls: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{harry}}},
+		{name: "certificate authentication disabled", tls: verified(harry)},
+		{name: "password takes precedence", field: CertUserCommonName, tls: verified(harry), user: "adam", password: "adamsStrongPassword", wantUser: "adam"},
+		{name: "wrong password takes precedence", field: CertUserCommonName, tls: verified(harry), user: "adam", password: "wrong"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			authz := NewFakeAuthorizer().Allow("*", "*", "*")
+			var opts []Option
+			if tc.field != "" {
+				opts = append(opts, WithClientCertAuth(tc.field))
+			}
+			s := newTestService(t, authz, opts...)
+
+			ctx := context.Background()
+			if err := s.users.CreateUser(ctx, db.UserRecord{Username: "ivy@example.com", Roles: []string{"customer"}}); err != nil {
+				t.Fatalf("Failed to create user: %v", err)
+			}
+			if err := s.users.UpdateUser(ctx, "jenny", func(u *db.UserRecord) { u.Disabled = true }); err != nil {
+				t.Fatalf("Failed to disable user: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/store/order", nil)
+			req.TLS = tc.tls
+			if tc.user != "" {
+				req.SetBasicAuth(tc.user, tc.password)
+			}
+
+			rec := httptest.NewRecorder()
+			s.Handler().ServeHTTP(rec, req)
+
+			if tc.wantUser == "" {
+				if rec.Code != http.StatusUnauthorized {
+					t.Fatalf("Expected status 401, got %d: %s", rec.Code, rec.Body)
+				}
+				return
+			}
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body)
+			}
+
+			calls := authz.Calls()
+			if len(calls) != 1 || calls[0].Principal != tc.wantUser {
+				t.Errorf("Expected a request for %s, got %+v", tc.wantUser, calls)
+			}
+		})
+	}
+}
+
+func TestClientCertPrincipal(t *testing.T) {
+	s := newTestService(t, NewFakeAuthorizer(), WithClientCertAuth(CertUserCommonName))
+
+	cert := newClientCert(t, x509.Certificate{
+		Subject:      pkix.Name{CommonName: "harry", OrganizationalUnit: []string{"warehouse", "night shift"}},
+		SerialNumber: big.NewInt(0xbeef),
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/store/order", nil)
+	req.RemoteAddr = "192.0.2.1:40001"
+	actx, err := s.buildCertAuthContext(cert, req)
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	if actx.username != "harry" || actx.method != authMethodCert {
+		t.Errorf("Expected harry authenticated with %s, got %s with %s", authMethodCert, actx.username, actx.method)
+	}
+
+	p := actx.principal.Obj
+	if !slices.Equal(p.GetRoles(), []string{"customer", "employee", "stocker"}) {
+		t.Errorf("Expected the roles of harry, got %v", p.GetRoles())
+	}
+
+	attr := p.GetAttr()
+	if got := attr["authMethod"].GetStringValue(); got != authMethodCert {
+		t.Errorf("Expected authMethod %s, got %s", authMethodCert, got)
+	}
+	if got := attr["ipAddress"].GetStringValue(); got != "192.0.2.1" {
+		t.Errorf("Expected ipAddress 192.0.2.1, got %s", got)
+	}
+
+	certAttr := attr["certificate"].GetStructValue().AsMap()
+	if got := certAttr["subject"]; got != cert.Subject.String() {
+		t.Errorf("Expected subject %q, got %q", cert.Subject.String(), got)
+	}
+	if got := certAttr["serial"]; got != "beef" {
+		t.Errorf("Expected serial beef, got %v", got)
+	}
+	if got, ok := certAttr["ou"].([]any); !ok || !slices.Equal(got, []any{"warehouse", "night shift"}) {
+		t.Errorf("Expected the organizational units, got %v", certAttr["ou"])
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type credentialKey [sha256.Size]byte
+
+type credentialEntry struct {
+	username string
+	// passwordHash is the hash that the password was verified against. An entry is only used while the
+	// stored hash is unchanged, so a password change made outside this service still takes effect.
+	passwordHash []byte
+	expires      time.Time
+}
+
+// credentialCache remembers recently verified username and password pairs to avoid running bcrypt on every request.
+// Entries are keyed by an HMAC of the credentials using a random per-process secret, so the cache never
+// holds the passwords themselves or anything that could be used to brute-force them offline.
+type credentialCache struct {
+	mu        sync.Mutex
+	secret    []byte
+	ttl       time.Duration
+	entries   map[credentialKey]credentialEntry
+	lastSweep time.Time
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+}
+
+// CacheStats are the counters of a cache.
+type CacheStats struct {
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	Entries int    `json:"entries"`
+}
+
+func newCredentialCache(ttl time.Duration) (*credentialCache, error) {
+	secret := make([]byte, sha256.Size)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	return &credentialCache{secret: secret, ttl: ttl, entries: make(map[credentialKey]credentialEntry), lastSweep: time.Now()}, nil
+}
+
+// WithCredentialCache caches successful password verifications for the given duration.
+func WithCredentialCache(ttl time.Duration) Option {
+	return func(s *Service) {
+		cache, err := newCredentialCache(ttl)
+		if err != nil {
+			// Without a secret the cache cannot be used safely, so passwords are verified on every request instead.
+			log.Printf("ERROR: failed to create credential cache: %v", err)
+			return
+		}
+		s.credentials = cache
+	}
+}
+
+func (c *credentialCache) key(username, password string) credentialKey {
+	var key credentialKey
+	mac := hmac.New(sha256.New, c.secret)
+	// The username is length-prefixed so that different pairs cannot produce the same input.
+	mac.Write(binary.BigEndian.AppendUint32(nil, uint32(len(username))))
+	mac.Write([]byte(username))
+	mac.Write([]byte(password))
+	mac.Sum(key[:0])
+
+	return key
+}
+
+// verified reports whether the credentials were recently verified against the given password hash.
+func (c *credentialCache) verified(username, password string, passwordHash []byte) bool {
+	key := c.key(username, password)
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+
+	if ok && e.username == username && time.Now().Before(e.expires) && subtle.ConstantTimeCompare(e.passwordHash, passwordHash) == 1 {
+		c.hits.Add(1)
+		return true
+	}
+
+	c.misses.Add(1)
+	return false
+}
+
+// add records that the credentials have been verified against the given password hash.
+func (c *credentialCache) add(username, password string, passwordHash []byte) {
+	key := c.key(username, password)
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sweep(now)
+	c.entries[key] = credentialEntry{username: username, passwordHash: passwordHash, expires: now.Add(c.ttl)}
+}
+
+// invalidate removes all the entries of the named user.
+func (c *credentialCache) invalidate(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, e := range c.entries {
+		if e.username == username {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// sweep removes expired entries. It must be called with the lock held.
+func (c *credentialCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < c.ttl {
+		return
+	}
+
+	for key, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.lastSweep = now
+}
+
+func (c *credentialCache) stats() CacheStats {
+	c.mu.Lock()
+	entries := len(c.entries)
+	c.mu.Unlock()
+
+	return CacheStats{Hits: c.hits.Load(), Misses: c.misses.Load(), Entries: entries}
+}
+
+// invalidateCredentials forgets the cached credentials of the named user after their account has changed.
+func (s *Service) invalidateCredentials(username string) {
+	if s.credentials != nil {
+		s.credentials.invalidate(username)
+	}
+}
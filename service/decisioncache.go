@@ -0,0 +1,292 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cerbos/cerbos-sdk-go/cerbos"
+	effectv1 "github.com/cerbos/cerbos/api/genpb/cerbos/effect/v1"
+	requestv1 "github.com/cerbos/cerbos/api/genpb/cerbos/request/v1"
+	responsev1 "github.com/cerbos/cerbos/api/genpb/cerbos/response/v1"
+	"github.com/rs/xid"
+	"google.golang.org/protobuf/proto"
+)
+
+const cacheResource = "cache"
+
+// readOnlyActions are the actions that do not change anything. All other actions are bypassed by the
+// decision cache when DecisionCacheConfig.BypassMutations is set.
+var readOnlyActions = []string{"VIEW", "VIEW_HISTORY", "VIEW_API_KEYS", "EXPLAIN"}
+
+// DecisionCacheConfig configures the cache of authorization decisions.
+type DecisionCacheConfig struct {
+	// TTL is how long decisions are cached. Policy changes take up to this long to take effect unless the cache is flushed.
+	TTL time.Duration
+	// MaxEntries is the number of decisions kept. The oldest decisions are evicted first.
+	MaxEntries int
+	// BypassMutations makes every action that is not in readOnlyActions go to the authorizer.
+	BypassMutations bool
+}
+
+// DefaultDecisionCacheConfig leaves the cache disabled. When it is enabled with a TTL, only the decisions of
+// read-only actions are cached so that policy changes never let a stale decision change anything.
+var DefaultDecisionCacheConfig = DecisionCacheConfig{MaxEntries: 10000, BypassMutations: true}
+
+type decisionCacheKey [sha256.Size]byte
+
+type decisionCacheEntry struct {
+	key     decisionCacheKey
+	allowed bool
+	expires time.Time
+}
+
+// decisionCache remembers the decisions made for a principal, resource and action. Principals and resources are keyed
+// by all their attributes, so a decision is never reused after the user or the resource has changed. Only policy
+// changes can make a cached decision stale, which is why the cache can be flushed.
+type decisionCache struct {
+	conf DecisionCacheConfig
+	mu   sync.Mutex
+	// entries indexes the elements of order, which holds decisionCacheEntry values from the oldest to the newest.
+	entries map[decisionCacheKey]*list.Element
+	order   *list.List
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+}
+
+// WithDecisionCache caches authorization decisions in front of the authorizer.
+func WithDecisionCache(conf DecisionCacheConfig) Option {
+	return func(s *Service) {
+		s.decisionCache = &decisionCache{conf: conf, entries: make(map[decisionCacheKey]*list.Element), order: list.New()}
+	}
+}
+
+// key returns a canonical hash of the principal, resource and action, and of the bearer token that is forwarded to the PDP
+// as auxiliary data. Each part is length-prefixed so that different requests cannot produce the same input.
+func (c *decisionCache) key(ctx context.Context, principal *cerbos.Principal, resource *cerbos.Resource, action string) (decisionCacheKey, error) {
+	var key decisionCacheKey
+	h := sha256.New()
+
+	for _, msg := range []proto.Message{principal.Obj, resource.Obj} {
+		// Deterministic marshaling orders the attribute maps, which is all that is needed within a process.
+		b, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+		if err != nil {
+			return key, err
+		}
+		writeKeyPart(h, b)
+	}
+
+	writeKeyPart(h, []byte(action))
+	if actx := getAuthContext(ctx); actx != nil {
+		writeKeyPart(h, []byte(actx.token))
+	}
+	h.Sum(key[:0])
+
+	return key, nil
+}
+
+func writeKeyPart(h hash.Hash, b []byte) {
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(len(b))))
+	h.Write(b)
+}
+
+// cacheable reports whether the decision for the action can come from the cache.
+func (c *decisionCache) cacheable(action string) bool {
+	return !c.conf.BypassMutations || slices.Contains(readOnlyActions, action)
+}
+
+func (c *decisionCache) get(key decisionCacheKey) (allowed, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.entries[key]; found {
+		e := elem.Value.(decisionCacheEntry)
+		if time.Now().Before(e.expires) {
+			c.hits.Add(1)
+			return e.allowed, true
+		}
+
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+
+	c.misses.Add(1)
+	return false, false
+}
+
+func (c *decisionCache) add(key decisionCacheKey, allowed bool) {
+	e := decisionCacheEntry{key: key, allowed: allowed, expires: time.Now().Add(c.conf.TTL)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.entries[key]; found {
+		c.order.Remove(elem)
+	}
+	c.entries[key] = c.order.PushBack(e)
+
+	// All entries have the same TTL, so the oldest one is also the first to expire.
+	for c.order.Len() > max(c.conf.MaxEntries, 1) {
+		oldest := c.order.Remove(c.order.Front()).(decisionCacheEntry)
+		delete(c.entries, oldest.key)
+	}
+}
+
+// flush removes all the entries and returns how many there were.
+func (c *decisionCache) flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := len(c.entries)
+	c.entries = make(map[decisionCacheKey]*list.Element)
+	c.order.Init()
+
+	return n
+}
+
+func (c *decisionCache) stats() CacheStats {
+	c.mu.Lock()
+	entries := len(c.entries)
+	c.mu.Unlock()
+
+	return CacheStats{Hits: c.hits.Load(), Misses: c.misses.Load(), Entries: entries}
+}
+
+// cachingAuthorizer answers checks from the decision cache and sends the rest to the next Authorizer.
+// Query plans are never cached because lists depend on the data as well as on the policies.
+type cachingAuthorizer struct {
+	next  Authorizer
+	cache *decisionCache
+}
+
+func (a cachingAuthorizer) IsAllowed(ctx context.Context, principal *cerbos.Principal, resource *cerbos.Resource, action string) (bool, error) {
+	resp, err := a.CheckResources(ctx, principal, cerbos.NewResourceBatch().Add(resource, action))
+	if err != nil {
+		return false, err
+	}
+
+	return resp.GetResource(resource.ID(), cerbos.MatchResourceKind(resource.Kind())).IsAllowed(action), nil
+}
+
+// CheckResources sends the actions that are not in the cache to the next Authorizer in a single batch and merges the
+// cached decisions into its response. The response has no call ID if every decision came from the cache.
+func (a cachingAuthorizer) CheckResources(ctx context.Context, principal *cerbos.Principal, batch *cerbos.ResourceBatch) (*cerbos.CheckResourcesResponse, error) {
+	type resourceDecisions struct {
+		entry   *requestv1.CheckResourcesRequest_ResourceEntry
+		cached  map[string]effectv1.Effect
+		pending map[string]decisionCacheKey
+	}
+
+	if err := batch.Validate(); err != nil {
+		return nil, err
+	}
+
+	all := make([]resourceDecisions, len(batch.Batch))
+	misses := cerbos.NewResourceBatch()
+	for i, entry := range batch.Batch {
+		rd := resourceDecisions{entry: entry, cached: make(map[string]effectv1.Effect), pending: make(map[string]decisionCacheKey)}
+		resource := &cerbos.Resource{Obj: entry.GetResource()}
+
+		var missed []string
+		for _, action := range entry.GetActions() {
+			if !a.cache.cacheable(action) {
+				missed = append(missed, action)
+				continue
+			}
+
+			key, err := a.cache.key(ctx, principal, resource, action)
+			if err != nil {
+				return nil, err
+			}
+
+			if allowed, ok := a.cache.get(key); ok {
+				rd.cached[action] = effect(allowed)
+				continue
+			}
+			rd.pending[action] = key
+			missed = append(missed, action)
+		}
+
+		if len(missed) > 0 {
+			misses.Add(resource, missed...)
+		}
+		all[i] = rd
+	}
+
+	resp := &cerbos.CheckResourcesResponse{CheckResourcesResponse: &responsev1.CheckResourcesResponse{RequestId: xid.New().String()}}
+	if len(misses.Batch) > 0 {
+		var err error
+		if resp, err = a.next.CheckResources(ctx, principal, misses); err != nil {
+			return nil, err
+		}
+	}
+
+	results := make([]*responsev1.CheckResourcesResponse_ResultEntry, len(all))
+	for i, rd := range all {
+		r := rd.entry.GetResource()
+		result := &responsev1.CheckResourcesResponse_ResultEntry{
+			Resource: &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: r.GetId(), Kind: r.GetKind(), PolicyVersion: r.GetPolicyVersion(), Scope: r.GetScope()},
+		}
+
+		if len(rd.cached) < len(rd.entry.GetActions()) {
+			rr := resp.GetResource(r.GetId(), cerbos.MatchResourceKind(r.GetKind()))
+			if rr.Err() == nil {
+				// Decisions made with invalid attributes are not cached so that the validation errors are reported every time.
+				valid := len(rr.GetValidationErrors()) == 0
+				for action, key := range rd.pending {
+					if valid {
+						a.cache.add(key, rr.IsAllowed(action))
+					}
+				}
+				result = proto.Clone(rr.CheckResourcesResponse_ResultEntry).(*responsev1.CheckResourcesResponse_ResultEntry)
+			}
+		}
+
+		if result.Actions == nil {
+			result.Actions = make(map[string]effectv1.Effect, len(rd.cached))
+		}
+		for action, eff := range rd.cached {
+			result.Actions[action] = eff
+		}
+		results[i] = result
+	}
+
+	return &cerbos.CheckResourcesResponse{
+		CheckResourcesResponse: &responsev1.CheckResourcesResponse{RequestId: resp.GetRequestId(), CerbosCallId: resp.GetCerbosCallId(), Results: results},
+	}, nil
+}
+
+func (a cachingAuthorizer) PlanResources(ctx context.Context, principal *cerbos.Principal, resource *cerbos.Resource, action string) (*cerbos.PlanResourcesResponse, error) {
+	return a.next.PlanResources(ctx, principal, resource, action)
+}
+
+func effect(allowed bool) effectv1.Effect {
+	if allowed {
+		return effectv1.Effect_EFFECT_ALLOW
+	}
+	return effectv1.Effect_EFFECT_DENY
+}
+
+func (s *Service) handleDecisionCacheFlush(w http.ResponseWriter, r *http.Request) {
+	defer cleanup(r)
+
+	if !s.authorize(w, r, cerbos.NewResource(cacheResource, "decisions"), "FLUSH") {
+		return
+	}
+
+	n := s.decisionCache.flush()
+	writeJSON(w, http.StatusOK, struct {
+		Message string `json:"message"`
+		Flushed int    `json:"flushed"`
+	}{Message: "Decision cache flushed", Flushed: n})
+}
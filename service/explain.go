@@ -0,0 +1,196 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/cerbos/cerbos-sdk-go/cerbos"
+	"github.com/cerbos/demo-rest/localpdp"
+)
+
+// explainRequest is the request body for explaining an authorization decision.
+type explainRequest struct {
+	Username     string `json:"username"`
+	ResourceKind string `json:"resourceKind"`
+	ResourceID   string `json:"resourceID"`
+	Action       string `json:"action"`
+	// AuthMethod is the authentication method that the user signed in with. It defaults to basic.
+	AuthMethod string `json:"authMethod"`
+	// Attr holds the extra attributes that handlers add for some actions, such as newStatus or pickQuantity.
+	Attr map[string]any `json:"attr"`
+}
+
+type explainedEntity struct {
+	ID    string         `json:"id"`
+	Kind  string         `json:"kind,omitempty"`
+	Roles []string       `json:"roles,omitempty"`
+	Attr  map[string]any `json:"attr"`
+}
+
+type validationError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+	Source  string `json:"source"`
+}
+
+// explanation is the response to an explain request.
+type explanation struct {
+	Principal             explainedEntity   `json:"principal"`
+	Resource              explainedEntity   `json:"resource"`
+	Action                string            `json:"action"`
+	Effect                string            `json:"effect"`
+	MatchedPolicy         string            `json:"matchedPolicy"`
+	MatchedScope          string            `json:"matchedScope,omitempty"`
+	EffectiveDerivedRoles []string          `json:"effectiveDerivedRoles"`
+	ValidationErrors      []validationError `json:"validationErrors"`
+	CallID                string            `json:"callID"`
+}
+
+var errUnknownResourceKind = errors.New("unknown resource kind")
+
+// WithDebug enables the endpoints that help to troubleshoot policies, such as /admin/explain.
+func WithDebug() Option {
+	return func(s *Service) {
+		s.debug = true
+	}
+}
+
+// handleExplain evaluates an action on behalf of another user and returns the details of how Cerbos reached the decision.
+// The decision is not enforced, so it is not recorded in the audit log.
+func (s *Service) handleExplain(w http.ResponseWriter, r *http.Request) {
+	defer cleanup(r)
+
+	var req explainRequest
+	if err := readJSON(r.Body, &req); err != nil || req.Username == "" || req.ResourceKind == "" || req.Action == "" {
+		log.Printf("ERROR: invalid explain request: %v", err)
+		writeMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+
+	if !s.authorize(w, r, cerbos.NewResource(auditLogResource, "decisions"), "EXPLAIN") {
+		return
+	}
+
+	// Explanations rely on the metadata returned by the PDP, which other authorizers do not provide.
+	if s.cerbos == nil {
+		writeMessage(w, http.StatusNotImplemented, "Explanations require the Cerbos PDP")
+		return
+	}
+
+	record, err := s.users.LookupUser(r.Context(), req.Username)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusBadRequest, "User not found")
+		return
+	}
+
+	// The principal and resource are built in exactly the same way as they are for a real request.
+	// The principal's IP address is the one of the caller because the original request is not available.
+	if req.AuthMethod == "" {
+		req.AuthMethod = authMethodBasic
+	}
+	principal := newAuthContext(record, req.AuthMethod, r).principal
+
+	resource, err := s.lookupResource(r.Context(), req.ResourceKind, req.ResourceID)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		if errors.Is(err, errUnknownResourceKind) {
+			writeMessage(w, http.StatusBadRequest, "Unknown resource kind")
+			return
+		}
+		writeMessage(w, http.StatusBadRequest, "Resource not found")
+		return
+	}
+
+	for k, v := range req.Attr {
+		resource = resource.WithAttr(k, v)
+	}
+
+	cctx, cancel := s.cerbosContext(r.Context())
+	defer cancel()
+
+	resp, err := s.cerbos.With(cerbos.IncludeMeta(true)).CheckResources(cctx, principal, cerbos.NewResourceBatch().Add(resource, req.Action))
+	if err != nil {
+		err = cerbosError(err)
+		log.Printf("ERROR: %v", err)
+		writeAuthzError(w, err, http.StatusInternalServerError, "Failed to explain decision")
+		return
+	}
+
+	result := resp.GetResource(resource.ID(), cerbos.MatchResourceKind(resource.Kind()))
+	if err := result.Err(); err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to explain decision")
+		return
+	}
+
+	exp := explanation{
+		Principal: explainedEntity{
+			ID:    principal.ID(),
+			Roles: principal.Roles(),
+			Attr:  localpdp.AttrValues(principal.Obj.GetAttr()),
+		},
+		Resource: explainedEntity{
+			ID:   resource.ID(),
+			Kind: resource.Kind(),
+			Attr: localpdp.AttrValues(resource.Obj.GetAttr()),
+		},
+		Action:                req.Action,
+		Effect:                result.GetActions()[req.Action].String(),
+		MatchedPolicy:         result.GetMeta().GetActions()[req.Action].GetMatchedPolicy(),
+		MatchedScope:          result.GetMeta().GetActions()[req.Action].GetMatchedScope(),
+		EffectiveDerivedRoles: result.GetMeta().GetEffectiveDerivedRoles(),
+		ValidationErrors:      make([]validationError, len(result.GetValidationErrors())),
+		CallID:                resp.GetCerbosCallId(),
+	}
+
+	for i, ve := range result.GetValidationErrors() {
+		exp.ValidationErrors[i] = validationError{Path: ve.GetPath(), Message: ve.GetMessage(), Source: ve.GetSource().String()}
+	}
+
+	writeJSON(w, http.StatusOK, exp)
+}
+
+// lookupResource retrieves a stored resource and converts it to a Cerbos resource the same way that the handlers do.
+func (s *Service) lookupResource(ctx context.Context, kind, id string) (*cerbos.Resource, error) {
+	switch kind {
+	case orderResource:
+		orderID, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		order, err := s.orders.Get(ctx, orderID)
+		if err != nil {
+			return nil, err
+		}
+
+		return toOrderResource(order), nil
+
+	case inventoryResource:
+		record, err := s.inventory.GetItem(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		return toInventoryResource(record), nil
+
+	case userResource:
+		user, err := s.users.LookupUser(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		return toUserResource(*user), nil
+
+	default:
+		return nil, fmt.Errorf("%w: %q", errUnknownResourceKind, kind)
+	}
+}
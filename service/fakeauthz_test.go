@@ -0,0 +1,200 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/cerbos/cerbos-sdk-go/cerbos"
+	effectv1 "github.com/cerbos/cerbos/api/genpb/cerbos/effect/v1"
+	enginev1 "github.com/cerbos/cerbos/api/genpb/cerbos/engine/v1"
+	responsev1 "github.com/cerbos/cerbos/api/genpb/cerbos/response/v1"
+	"github.com/rs/xid"
+)
+
+var _ Authorizer = (*FakeAuthorizer)(nil)
+
+// fakeWildcard matches every principal, resource kind or action in the rules of a FakeAuthorizer.
+const fakeWildcard = "*"
+
+// FakeAuthorizer is an Authorizer for tests that makes decisions from a list of scripted rules instead of policies.
+// Everything is denied unless allowed by a rule, and a matching Deny rule overrides any Allow rule.
+// It is safe for concurrent use.
+type FakeAuthorizer struct {
+	mu    sync.Mutex
+	rules []fakeRule
+	plans map[fakePlanKey]*enginev1.PlanResourcesFilter
+	err   error
+	calls []FakeCall
+}
+
+type fakeRule struct {
+	principal string
+	kind      string
+	action    string
+	allow     bool
+}
+
+type fakePlanKey struct {
+	kind   string
+	action string
+}
+
+// FakeCall records a request made to a FakeAuthorizer. Batch checks are recorded as one call per resource.
+type FakeCall struct {
+	Method    string
+	Principal string
+	Kind      string
+	ID        string
+	Actions   []string
+}
+
+// NewFakeAuthorizer creates a FakeAuthorizer that denies everything.
+func NewFakeAuthorizer() *FakeAuthorizer {
+	return &FakeAuthorizer{plans: make(map[fakePlanKey]*enginev1.PlanResourcesFilter)}
+}
+
+// Allow allows the principal to perform the action on resources of the given kind. Any of the arguments can be "*".
+func (f *FakeAuthorizer) Allow(principal, kind, action string) *FakeAuthorizer {
+	return f.addRule(fakeRule{principal: principal, kind: kind, action: action, allow: true})
+}
+
+// Deny denies the principal the action on resources of the given kind, even if another rule allows it.
+// Any of the arguments can be "*".
+func (f *FakeAuthorizer) Deny(principal, kind, action string) *FakeAuthorizer {
+	return f.addRule(fakeRule{principal: principal, kind: kind, action: action})
+}
+
+func (f *FakeAuthorizer) addRule(r fakeRule) *FakeAuthorizer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rules = append(f.rules, r)
+	return f
+}
+
+// SetPlan makes PlanResources return the given filter for the kind and action, whoever the principal is.
+// Without a filter, the plan is ALWAYS_ALLOWED if the rules allow the action and ALWAYS_DENIED otherwise.
+func (f *FakeAuthorizer) SetPlan(kind, action string, filter *enginev1.PlanResourcesFilter) *FakeAuthorizer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.plans[fakePlanKey{kind: kind, action: action}] = filter
+	return f
+}
+
+// Fail makes every subsequent request fail with err. Passing nil makes requests succeed again.
+func (f *FakeAuthorizer) Fail(err error) *FakeAuthorizer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.err = err
+	return f
+}
+
+// Calls returns the requests made so far, in order.
+func (f *FakeAuthorizer) Calls() []FakeCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return slices.Clone(f.calls)
+}
+
+func (f *FakeAuthorizer) IsAllowed(ctx context.Context, principal *cerbos.Principal, resource *cerbos.Resource, action string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls = append(f.calls, FakeCall{Method: "IsAllowed", Principal: principal.ID(), Kind: resource.Kind(), ID: resource.ID(), Actions: []string{action}})
+	if f.err != nil {
+		return false, f.err
+	}
+
+	return f.allowed(principal.ID(), resource.Kind(), action), nil
+}
+
+func (f *FakeAuthorizer) CheckResources(ctx context.Context, principal *cerbos.Principal, batch *cerbos.ResourceBatch) (*cerbos.CheckResourcesResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, entry := range batch.Batch {
+		r := entry.GetResource()
+		f.calls = append(f.calls, FakeCall{Method: "CheckResources", Principal: principal.ID(), Kind: r.GetKind(), ID: r.GetId(), Actions: entry.GetActions()})
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	results := make([]*responsev1.CheckResourcesResponse_ResultEntry, len(batch.Batch))
+	for i, entry := range batch.Batch {
+		r := entry.GetResource()
+		effects := make(map[string]effectv1.Effect, len(entry.GetActions()))
+		for _, action := range entry.GetActions() {
+			effects[action] = effectv1.Effect_EFFECT_DENY
+			if f.allowed(principal.ID(), r.GetKind(), action) {
+				effects[action] = effectv1.Effect_EFFECT_ALLOW
+			}
+		}
+
+		results[i] = &responsev1.CheckResourcesResponse_ResultEntry{
+			Resource: &responsev1.CheckResourcesResponse_ResultEntry_Resource{Id: r.GetId(), Kind: r.GetKind(), PolicyVersion: r.GetPolicyVersion()},
+			Actions:  effects,
+		}
+	}
+
+	return &cerbos.CheckResourcesResponse{
+		CheckResourcesResponse: &responsev1.CheckResourcesResponse{RequestId: xid.New().String(), Results: results},
+	}, nil
+}
+
+func (f *FakeAuthorizer) PlanResources(ctx context.Context, principal *cerbos.Principal, resource *cerbos.Resource, action string) (*cerbos.PlanResourcesResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls = append(f.calls, FakeCall{Method: "PlanResources", Principal: principal.ID(), Kind: resource.Kind(), Actions: []string{action}})
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	filter, ok := f.plans[fakePlanKey{kind: resource.Kind(), action: action}]
+	switch {
+	case ok:
+	case f.allowed(principal.ID(), resource.Kind(), action):
+		filter = &enginev1.PlanResourcesFilter{Kind: enginev1.PlanResourcesFilter_KIND_ALWAYS_ALLOWED}
+	default:
+		filter = &enginev1.PlanResourcesFilter{Kind: enginev1.PlanResourcesFilter_KIND_ALWAYS_DENIED}
+	}
+
+	return &cerbos.PlanResourcesResponse{
+		PlanResourcesResponse: &responsev1.PlanResourcesResponse{
+			RequestId:     xid.New().String(),
+			Action:        action,
+			ResourceKind:  resource.Kind(),
+			PolicyVersion: resource.Obj.GetPolicyVersion(),
+			Filter:        filter,
+		},
+	}, nil
+}
+
+// allowed reports whether the rules allow the action. The caller must hold the lock.
+func (f *FakeAuthorizer) allowed(principal, kind, action string) bool {
+	allowed := false
+	for _, r := range f.rules {
+		if !fakeMatch(r.principal, principal) || !fakeMatch(r.kind, kind) || !fakeMatch(r.action, action) {
+			continue
+		}
+
+		if !r.allow {
+			return false
+		}
+		allowed = true
+	}
+
+	return allowed
+}
+
+func fakeMatch(pattern, value string) bool {
+	return pattern == fakeWildcard || pattern == value
+}
@@ -0,0 +1,247 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cerbos/demo-rest/db"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+const (
+	jwtIssuer = "demo-rest"
+	// minHMACKeyLen is the minimum length of an HS256 secret, which must be at least as long as the hash output.
+	minHMACKeyLen = 32
+)
+
+var (
+	errTokensDisabled = errors.New("bearer tokens are not enabled")
+	errTokenOutdated  = errors.New("token roles or aisles no longer match the user")
+)
+
+// TokenIssuer signs and verifies the JWTs used for bearer token authentication.
+type TokenIssuer struct {
+	alg       jwa.SignatureAlgorithm
+	signKey   jwk.Key
+	verifyKey jwk.Key
+	ttl       time.Duration
+}
+
+// NewTokenIssuer creates a TokenIssuer that signs tokens valid for the given duration using HS256 or ES256.
+// The key is the shared secret for HS256 and a PEM encoded EC private key for ES256.
+// If the key is empty, a random one is generated and tokens become invalid when the service restarts.
+func NewTokenIssuer(alg string, key []byte, ttl time.Duration) (*TokenIssuer, error) {
+	ti := &TokenIssuer{ttl: ttl}
+
+	var err error
+	switch alg {
+	case "HS256":
+		ti.alg = jwa.HS256
+		secret := bytes.TrimSpace(key)
+		if len(secret) == 0 {
+			secret = make([]byte, minHMACKeyLen)
+			if _, err := rand.Read(secret); err != nil {
+				return nil, fmt.Errorf("failed to generate HS256 key: %w", err)
+			}
+		}
+
+		if len(secret) < minHMACKeyLen {
+			return nil, fmt.Errorf("HS256 key must be at least %d bytes long", minHMACKeyLen)
+		}
+
+		if ti.signKey, err = jwk.FromRaw(secret); err != nil {
+			return nil, fmt.Errorf("invalid HS256 key: %w", err)
+		}
+		ti.verifyKey = ti.signKey
+
+	case "ES256":
+		ti.alg = jwa.ES256
+		if len(key) == 0 {
+			privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				return nil, fmt.Errorf("failed to generate ES256 key: %w", err)
+			}
+			ti.signKey, err = jwk.FromRaw(privateKey)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ES256 key: %w", err)
+			}
+		} else if ti.signKey, err = jwk.ParseKey(key, jwk.WithPEM(true)); err != nil {
+			return nil, fmt.Errorf("invalid ES256 key: %w", err)
+		}
+
+		if _, ok := ti.signKey.(jwk.ECDSAPrivateKey); !ok {
+			return nil, errors.New("ES256 key must be an EC private key")
+		}
+
+		if ti.verifyKey, err = jwk.PublicKeyOf(ti.signKey); err != nil {
+			return nil, fmt.Errorf("invalid ES256 key: %w", err)
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", alg)
+	}
+
+	return ti, nil
+}
+
+// issue creates a signed token carrying the username, roles and aisles of the given user.
+func (ti *TokenIssuer) issue(user *db.UserRecord) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(ti.ttl)
+
+	token, err := jwt.NewBuilder().
+		Issuer(jwtIssuer).
+		Subject(user.Username).
+		IssuedAt(now).
+		Expiration(expiresAt).
+		Claim("roles", user.Roles).
+		Claim("aisles", user.Aisles).
+		Build()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	signed, err := jwt.Sign(token, jwt.WithKey(ti.alg, ti.signKey))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return string(signed), expiresAt, nil
+}
+
+// verify checks the signature and validity of a token and returns the user described by its claims.
+func (ti *TokenIssuer) verify(token string) (*db.UserRecord, error) {
+	parsed, err := jwt.ParseString(token, jwt.WithKey(ti.alg, ti.verifyKey), jwt.WithValidate(true), jwt.WithIssuer(jwtIssuer))
+	if err != nil {
+		return nil, err
+	}
+
+	if parsed.Subject() == "" {
+		return nil, errors.New("token has no subject")
+	}
+
+	claims := parsed.PrivateClaims()
+
+	return &db.UserRecord{
+		Username: parsed.Subject(),
+		Roles:    stringList(claims["roles"]),
+		Aisles:   stringList(claims["aisles"]),
+	}, nil
+}
+
+// stringList converts a JSON array claim to a list of strings, ignoring any values that are not strings.
+func stringList(v any) []string {
+	items, _ := v.([]any)
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			list = append(list, s)
+		}
+	}
+
+	return list
+}
+
+// sameElements reports whether the lists contain the same strings, in any order.
+func sameElements(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+
+	return slices.Equal(slices.Compact(a), slices.Compact(b))
+}
+
+// WithTokenIssuer enables bearer token authentication and the login endpoint.
+func WithTokenIssuer(ti *TokenIssuer) Option {
+	return func(s *Service) {
+		s.tokens = ti
+	}
+}
+
+// bearerToken returns the token from the Authorization header if the request uses the Bearer scheme.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+
+	return strings.TrimSpace(token), true
+}
+
+// buildTokenAuthContext verifies a bearer token and returns a new authContext object built from the current record of its user.
+func (s *Service) buildTokenAuthContext(token string, r *http.Request) (*authContext, error) {
+	if s.tokens == nil {
+		return nil, errTokensDisabled
+	}
+
+	claims, err := s.tokens.verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	// The token must not outlive the account, nor grant roles or aisles that the user no longer has.
+	// The claims are checked as well as the record because the token is forwarded to Cerbos.
+	record, err := s.users.LookupUser(r.Context(), claims.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	if record.Disabled {
+		return nil, errUserDisabled
+	}
+
+	if !sameElements(claims.Roles, record.Roles) || !sameElements(claims.Aisles, record.Aisles) {
+		return nil, errTokenOutdated
+	}
+
+	actx := newAuthContext(record, authMethodJWT, r)
+	actx.token = token
+
+	return actx, nil
+}
+
+func (s *Service) handleLogin(w http.ResponseWriter, r *http.Request) {
+	defer cleanup(r)
+
+	// Tokens can only be obtained with a password so that they cannot be renewed indefinitely.
+	actx := getAuthContext(r.Context())
+	if actx == nil || actx.method != authMethodBasic {
+		w.Header().Set("WWW-Authenticate", `Basic realm="auth"`)
+		writeMessage(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	record, err := s.users.LookupUser(r.Context(), actx.username)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to issue token")
+		return
+	}
+
+	token, expiresAt, err := s.tokens.issue(record)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to issue token")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Token     string    `json:"token"`
+		TokenType string    `json:"tokenType"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}{Token: token, TokenType: "Bearer", ExpiresAt: expiresAt})
+}
@@ -0,0 +1,90 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	"context"
+
+	"github.com/cerbos/cerbos-sdk-go/cerbos"
+	responsev1 "github.com/cerbos/cerbos/api/genpb/cerbos/response/v1"
+	"github.com/cerbos/demo-rest/localpdp"
+	"github.com/rs/xid"
+)
+
+// WithLocalPolicies evaluates policies in-process with the given engine instead of calling the Cerbos PDP.
+func WithLocalPolicies(engine *localpdp.Engine) Option {
+	return func(s *Service) {
+		s.authz = localAuthorizer{engine: engine}
+		s.localFallback = nil
+	}
+}
+
+// WithLocalFallback calls the Cerbos PDP and only evaluates policies in-process with the given engine if the PDP is unavailable.
+func WithLocalFallback(engine *localpdp.Engine) Option {
+	return func(s *Service) {
+		s.localFallback = localAuthorizer{engine: engine}
+	}
+}
+
+// localAuthorizer evaluates policies in-process. Evaluation does not block, so contexts are not used.
+type localAuthorizer struct {
+	engine *localpdp.Engine
+}
+
+func (a localAuthorizer) IsAllowed(ctx context.Context, principal *cerbos.Principal, resource *cerbos.Resource, action string) (bool, error) {
+	resp, err := a.CheckResources(ctx, principal, cerbos.NewResourceBatch().Add(resource, action))
+	if err != nil {
+		return false, err
+	}
+
+	return resp.GetResource(resource.ID(), cerbos.MatchResourceKind(resource.Kind())).IsAllowed(action), nil
+}
+
+func (a localAuthorizer) CheckResources(_ context.Context, principal *cerbos.Principal, batch *cerbos.ResourceBatch) (*cerbos.CheckResourcesResponse, error) {
+	if err := principal.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := batch.Validate(); err != nil {
+		return nil, err
+	}
+
+	results := make([]*responsev1.CheckResourcesResponse_ResultEntry, len(batch.Batch))
+	for i, entry := range batch.Batch {
+		results[i] = &responsev1.CheckResourcesResponse_ResultEntry{
+			Resource: &responsev1.CheckResourcesResponse_ResultEntry_Resource{
+				Id:            entry.GetResource().GetId(),
+				Kind:          entry.GetResource().GetKind(),
+				PolicyVersion: entry.GetResource().GetPolicyVersion(),
+				Scope:         entry.GetResource().GetScope(),
+			},
+			Actions: a.engine.Check(principal.Obj, entry.GetResource(), entry.GetActions()),
+		}
+	}
+
+	return &cerbos.CheckResourcesResponse{
+		CheckResourcesResponse: &responsev1.CheckResourcesResponse{RequestId: xid.New().String(), Results: results},
+	}, nil
+}
+
+func (a localAuthorizer) PlanResources(_ context.Context, principal *cerbos.Principal, resource *cerbos.Resource, action string) (*cerbos.PlanResourcesResponse, error) {
+	if err := principal.Validate(); err != nil {
+		return nil, err
+	}
+
+	filter, err := a.engine.Plan(principal.Obj, resource.Obj, action)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cerbos.PlanResourcesResponse{
+		PlanResourcesResponse: &responsev1.PlanResourcesResponse{
+			RequestId:     xid.New().String(),
+			Action:        action,
+			ResourceKind:  resource.Kind(),
+			PolicyVersion: resource.Obj.GetPolicyVersion(),
+			Filter:        filter,
+		},
+	}, nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	"net/http"
+
+	"github.com/cerbos/cerbos-sdk-go/cerbos"
+)
+
+const metricsResource = "metrics"
+
+// metrics are the counters reported by the /admin/metrics endpoint. Features that are disabled are omitted.
+type metrics struct {
+	CredentialCache *CacheStats  `json:"credentialCache,omitempty"`
+	DecisionCache   *CacheStats  `json:"decisionCache,omitempty"`
+	Shadow          *ShadowStats `json:"shadow,omitempty"`
+}
+
+func (s *Service) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	defer cleanup(r)
+
+	if !s.authorize(w, r, cerbos.NewResource(metricsResource, "service"), "VIEW") {
+		return
+	}
+
+	var m metrics
+	if s.credentials != nil {
+		stats := s.credentials.stats()
+		m.CredentialCache = &stats
+	}
+	if s.decisionCache != nil {
+		stats := s.decisionCache.stats()
+		m.DecisionCache = &stats
+	}
+	if s.shadow != nil {
+		stats := s.shadow.stats()
+		m.Shadow = &stats
+	}
+
+	writeJSON(w, http.StatusOK, m)
+}
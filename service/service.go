@@ -6,26 +6,61 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net/http"
+	"net/url"
+	"slices"
+	"sort"
 	"strconv"
+	"time"
 
 	"github.com/cerbos/cerbos-sdk-go/cerbos"
+	"github.com/cerbos/demo-rest/audit"
 	"github.com/cerbos/demo-rest/db"
+	"github.com/cerbos/demo-rest/lockout"
+	"github.com/cerbos/demo-rest/queryplan"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/rs/xid"
 	"golang.org/x/crypto/bcrypt"
 )
 
+var errUserDisabled = errors.New("user is disabled")
+
+// errOrderChanged is returned when an order has changed between being authorized and being updated.
+var errOrderChanged = errors.New("order was changed by another request")
+
 type authCtxKeyType struct{}
 
 var authCtxKey = authCtxKeyType{}
 
+type requestIDCtxKeyType struct{}
+
+var requestIDCtxKey = requestIDCtxKeyType{}
+
+const (
+	requestIDHeader = "X-Request-ID"
+	maxRequestIDLen = 128
+)
+
+// Authentication methods, exposed to policies as the authMethod principal attribute.
+const (
+	authMethodBasic  = "basic"
+	authMethodJWT    = "jwt"
+	authMethodAPIKey = "apikey"
+	authMethodCert   = "certificate"
+)
+
 type authContext struct {
 	username  string
 	principal *cerbos.Principal
+	method    string
+	// token is the bearer token used to authenticate the request, if any. It is forwarded to Cerbos as auxiliary data.
+	token string
 }
 
 const (
@@ -33,12 +68,21 @@ const (
 	orderResource     = "order"
 )
 
+var (
+	// orderActions are the actions in the order policy that apply to an existing order.
+	// UPDATE_STATUS is checked without a target status, so it is only reported for principals who can move the order to any status.
+	orderActions = []string{"VIEW", "VIEW_HISTORY", "UPDATE", "DELETE", "UPDATE_STATUS"}
+	// inventoryActions are the actions in the inventory policy that apply to an existing item.
+	inventoryActions = []string{"VIEW", "UPDATE", "DELETE", "PICK", "REPLENISH"}
+)
+
 // toOrderResource creates a Cerbos resource from the given order.
 func toOrderResource(o db.Order) *cerbos.Resource {
 	return cerbos.NewResource(orderResource, strconv.FormatUint(o.ID, 10)).
 		WithAttr("items", o.Items).
-		WithAttr("status", o.Status).
-		WithAttr("owner", o.Owner)
+		WithAttr("status", string(o.Status)).
+		WithAttr("owner", o.Owner).
+		WithAttr("total", o.Total)
 }
 
 // toInventoryResource creates a Cerbos resource from the given inventory record.
@@ -49,119 +93,423 @@ func toInventoryResource(i db.InventoryRecord) *cerbos.Resource {
 		WithAttr("quantity", i.Quantity)
 }
 
+// Stores holds the storage backends used by the service.
+type Stores struct {
+	Orders    db.OrderStore
+	Inventory db.InventoryStore
+	Users     db.UserStore
+	APIKeys   db.APIKeyStore
+}
+
+// InMemoryStores returns a set of stores that keep all data in memory.
+func InMemoryStores() Stores {
+	return Stores{Orders: db.NewOrderDB(), Inventory: db.NewInventory(), Users: db.NewUserDB(), APIKeys: db.NewAPIKeyDB()}
+}
+
 // Service implements the store API.
 type Service struct {
-	cerbos    *cerbos.GRPCClient
-	orders    *db.OrderDB
-	inventory *db.Inventory
+	// authz makes the authorization decisions. It wraps cerbos unless another Authorizer was given to New.
+	authz Authorizer
+	// cerbos is the client of the Cerbos PDP. It is nil if the PDP is not used.
+	cerbos     *cerbos.GRPCClient
+	cerbosConf CerbosConfig
+	orders     db.OrderStore
+	inventory  db.InventoryStore
+	users      db.UserStore
+	apiKeys    db.APIKeyStore
+	// auditBuffer keeps the most recent decisions for the /admin/audit endpoint.
+	auditBuffer *audit.RingBuffer
+	auditSinks  []audit.Sink
+	audit       audit.Sink
+	// debug enables endpoints that help to troubleshoot policies.
+	debug bool
+	// accountAttempts and clientAttempts track failed authentication attempts by username and by client IP address.
+	accountAttempts lockout.Tracker
+	clientAttempts  lockout.Tracker
+	// tokens issues and verifies bearer tokens. Bearer token authentication is disabled if it is nil.
+	tokens *TokenIssuer
+	// credentials caches recently verified passwords. Passwords are verified on every request if it is nil.
+	credentials *credentialCache
+	// certUserField is the client certificate field that names the user. Client certificates are ignored if it is empty.
+	certUserField CertUserField
+	// localFallback makes the decisions when the PDP is unavailable. Requests fail if it is nil.
+	localFallback Authorizer
+	// decisionCache caches the decisions of authz, except those made by localFallback. Every check goes to authz if it is nil.
+	decisionCache *decisionCache
+	// shadow evaluates checks against other policies in the background. Shadow evaluation is disabled if it is nil.
+	shadow *shadowEvaluator
 }
 
-func New(cerbosAddr string) (*Service, error) {
-	c, err := cerbos.New(cerbosAddr, cerbos.WithPlaintext())
-	if err != nil {
-		return nil, err
+// Option configures optional features of the service.
+type Option func(*Service)
+
+func New(cerbosAddr string, stores Stores, opts ...Option) (*Service, error) {
+	s := &Service{
+		cerbosConf:      DefaultCerbosConfig,
+		orders:          stores.Orders,
+		inventory:       stores.Inventory,
+		users:           stores.Users,
+		apiKeys:         stores.APIKeys,
+		auditBuffer:     audit.NewRingBuffer(defaultAuditBufferSize),
+		accountAttempts: lockout.NewMemory(lockout.DefaultAccountConfig),
+		clientAttempts:  lockout.NewMemory(lockout.DefaultClientConfig),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.authz == nil {
+		c, err := newCerbosClient(cerbosAddr, s.cerbosConf)
+		if err != nil {
+			return nil, err
+		}
+		s.cerbos = c
+		s.authz = grpcAuthorizer{client: c}
+	}
+
+	if s.shadow != nil && s.shadow.authz == nil {
+		if s.cerbos == nil {
+			return nil, errors.New("shadow evaluation needs the Cerbos PDP")
+		}
+		s.shadow.authz = grpcAuthorizer{client: s.cerbos}
 	}
 
-	return &Service{cerbos: c, orders: db.NewOrderDB(), inventory: db.NewInventory()}, nil
+	// The cache only holds the decisions of the primary authorizer. Decisions made by the fallback while the PDP is
+	// unavailable must not outlive the outage.
+	if s.decisionCache != nil {
+		s.authz = cachingAuthorizer{next: s.authz, cache: s.decisionCache}
+	}
+
+	if s.localFallback != nil {
+		s.authz = fallbackAuthorizer{primary: s.authz, fallback: s.localFallback}
+	}
+
+	s.audit = append(audit.MultiSink{s.auditBuffer}, s.auditSinks...)
+
+	return s, nil
 }
 
 func (s *Service) Handler() http.Handler {
-	authn := authenticationMiddleware
+	authn := s.authenticationMiddleware
 
 	r := mux.NewRouter()
-	r.Use(authn)
+	r.Use(requestIDMiddleware, authn)
 
 	r.HandleFunc("/store/order", s.handleOrderCreate).Methods(http.MethodPut)
+	r.HandleFunc("/store/order", s.handleOrderList).Methods(http.MethodGet)
 	r.HandleFunc("/store/order/{orderID}", s.handleOrderUpdate).Methods(http.MethodPost)
 	r.HandleFunc("/store/order/{orderID}", s.handleOrderDelete).Methods(http.MethodDelete)
 	r.HandleFunc("/store/order/{orderID}", s.handleOrderView).Methods(http.MethodGet)
+	r.HandleFunc("/store/order/{orderID}/history", s.handleOrderHistory).Methods(http.MethodGet)
 
 	r.HandleFunc("/backoffice/order/{orderID}/status/{status}", s.handleBackofficeOrderUpdate).Methods(http.MethodPost)
+	r.HandleFunc("/backoffice/orders/status", s.handleBackofficeBulkOrderUpdate).Methods(http.MethodPost)
 
 	r.HandleFunc("/backoffice/inventory", s.handleInventoryAdd).Methods(http.MethodPut)
+	r.HandleFunc("/backoffice/inventory", s.handleInventoryList).Methods(http.MethodGet)
 	r.HandleFunc("/backoffice/inventory/{itemID}", s.handleInventoryUpdate).Methods(http.MethodPost)
 	r.HandleFunc("/backoffice/inventory/{itemID}", s.handleInventoryDelete).Methods(http.MethodDelete)
 	r.HandleFunc("/backoffice/inventory/{itemID}", s.handleInventoryGet).Methods(http.MethodGet)
 	r.HandleFunc("/backoffice/inventory/{itemID}/pick/{quantity}", s.handleInventoryPick).Methods(http.MethodPost)
 	r.HandleFunc("/backoffice/inventory/{itemID}/replenish/{quantity}", s.handleInventoryReplenish).Methods(http.MethodPost)
 
+	r.HandleFunc("/admin/users", s.handleUserList).Methods(http.MethodGet)
+	r.HandleFunc("/admin/users", s.handleUserCreate).Methods(http.MethodPut)
+	r.HandleFunc("/admin/users/{username}", s.handleUserView).Methods(http.MethodGet)
+	r.HandleFunc("/admin/users/{username}", s.handleUserUpdate).Methods(http.MethodPost)
+	r.HandleFunc("/admin/users/{username}", s.handleUserDelete).Methods(http.MethodDelete)
+	r.HandleFunc("/admin/users/{username}/password", s.handleUserResetPassword).Methods(http.MethodPost)
+	r.HandleFunc("/admin/users/{username}/disable", s.handleUserDisable).Methods(http.MethodPost)
+	r.HandleFunc("/admin/users/{username}/enable", s.handleUserEnable).Methods(http.MethodPost)
+	r.HandleFunc("/admin/users/{username}/unlock", s.handleUserUnlock).Methods(http.MethodPost)
+	r.HandleFunc("/admin/users/{username}/keys", s.handleAPIKeyList).Methods(http.MethodGet)
+	r.HandleFunc("/admin/users/{username}/keys", s.handleAPIKeyCreate).Methods(http.MethodPut)
+	r.HandleFunc("/admin/users/{username}/keys/{keyID}", s.handleAPIKeyRevoke).Methods(http.MethodDelete)
+
+	r.HandleFunc("/admin/audit", s.handleAuditQuery).Methods(http.MethodGet)
+	r.HandleFunc("/admin/metrics", s.handleMetrics).Methods(http.MethodGet)
+	if s.decisionCache != nil {
+		r.HandleFunc("/admin/cache/decisions", s.handleDecisionCacheFlush).Methods(http.MethodDelete)
+	}
+	if s.debug {
+		r.HandleFunc("/admin/explain", s.handleExplain).Methods(http.MethodPost)
+	}
+
+	if s.tokens != nil {
+		r.HandleFunc("/auth/login", s.handleLogin).Methods(http.MethodPost)
+	}
+
 	r.HandleFunc("/health", s.handleHealth)
 
 	return handlers.LoggingHandler(log.Writer(), r)
 }
 
-// authenticationMiddleware handles the verification of username and password,
+// requestIDMiddleware assigns an ID to each request, reusing the X-Request-ID header sent by the client if there is one.
+// The ID is added to the request context and echoed back in the response headers.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if requestID == "" || len(requestID) > maxRequestIDLen {
+			requestID = xid.New().String()
+		}
+
+		w.Header().Set(requestIDHeader, requestID)
+		ctx := context.WithValue(r.Context(), requestIDCtxKey, requestID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func getRequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDCtxKey).(string)
+	return id
+}
+
+// authenticationMiddleware handles the verification of bearer tokens, API keys, username and password or client certificates,
 // creates a Cerbos principal and adds it to the request context.
-func authenticationMiddleware(next http.Handler) http.Handler {
+func (s *Service) authenticationMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Get the basic auth credentials from the request.
-		user, password, ok := r.BasicAuth()
-		if ok {
+		// Clients that have made too many failed attempts are turned away before any credentials are checked.
+		ip := clientIP(r)
+		if wait := s.retryAfter(r.Context(), s.clientAttempts, ip); wait > 0 {
+			writeTooManyAttempts(w, wait)
+			return
+		}
+
+		var authCtx *authContext
+		var method string
+		var err error
+
+		if token, ok := bearerToken(r); ok {
+			// Verify the token and build the auth context from the record of its user.
+			method = authMethodJWT
+			authCtx, err = s.buildTokenAuthContext(token, r)
+		} else if key := r.Header.Get(apiKeyHeader); key != "" {
+			// Verify the key and build the auth context with the roles that the key is scoped to.
+			method = authMethodAPIKey
+			authCtx, err = s.buildAPIKeyAuthContext(key, r)
+		} else if user, password, ok := r.BasicAuth(); ok {
+			method = authMethodBasic
+			if wait := s.retryAfter(r.Context(), s.accountAttempts, user); wait > 0 {
+				writeTooManyAttempts(w, wait)
+				return
+			}
+
 			// check the password and retrieve the auth context.
-			authCtx, err := buildAuthContext(user, password, r)
+			authCtx, err = s.buildAuthContext(user, password, r)
 			if err != nil {
-				log.Printf("Failed to authenticate user [%s]: %v", user, err)
+				s.recordFailure(r.Context(), s.accountAttempts, user)
 			} else {
-				// Add the retrieved principal to the context.
-				ctx := context.WithValue(r.Context(), authCtxKey, authCtx)
-				next.ServeHTTP(w, r.WithContext(ctx))
-
-				return
+				s.resetFailures(r.Context(), s.accountAttempts, user)
 			}
+		} else if cert, ok := clientCert(r); ok && s.certUserField != "" {
+			// Requests without other credentials are authenticated as the user named by the client certificate.
+			method = authMethodCert
+			authCtx, err = s.buildCertAuthContext(cert, r)
+		}
+
+		if err != nil {
+			// The username is not logged because users sometimes type their password into the username field.
+			log.Printf("Failed to authenticate request [%s] from %s using %s: %v", getRequestID(r.Context()), ip, method, err)
+			s.recordFailure(r.Context(), s.clientAttempts, ip)
+		}
+
+		if authCtx != nil {
+			// Add the retrieved principal to the context and attribute any changes to the user.
+			ctx := context.WithValue(r.Context(), authCtxKey, authCtx)
+			ctx = db.WithActor(ctx, db.Actor{Username: authCtx.username, RequestID: getRequestID(ctx)})
+			next.ServeHTTP(w, r.WithContext(ctx))
+
+			return
 		}
 
 		// No credentials provided or the credentials are invalid.
 		w.Header().Set("WWW-Authenticate", `Basic realm="auth"`)
+		if s.tokens != nil {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="auth"`)
+		}
 		writeMessage(w, http.StatusUnauthorized, "Authentication required")
 	})
 }
 
 // buildAuthContext verifies the username and password and returns a new authContext object.
-func buildAuthContext(username, password string, r *http.Request) (*authContext, error) {
+func (s *Service) buildAuthContext(username, password string, r *http.Request) (*authContext, error) {
 	// Lookup the user from the database.
-	record, err := db.LookupUser(r.Context(), username)
+	record, err := s.users.LookupUser(r.Context(), username)
 	if err != nil {
 		return nil, err
 	}
 
-	// Check that the password matches.
-	if err := bcrypt.CompareHashAndPassword(record.PasswordHash, []byte(password)); err != nil {
-		return nil, err
+	if record.Disabled {
+		return nil, errUserDisabled
+	}
+
+	// Check that the password matches, unless it has been verified recently.
+	if s.credentials == nil || !s.credentials.verified(username, password, record.PasswordHash) {
+		if err := bcrypt.CompareHashAndPassword(record.PasswordHash, []byte(password)); err != nil {
+			return nil, err
+		}
+
+		if s.credentials != nil {
+			s.credentials.add(username, password, record.PasswordHash)
+		}
 	}
 
+	return newAuthContext(record, authMethodBasic, r), nil
+}
+
+// newAuthContext creates the auth context for a user whose identity has been verified using the given method.
+func newAuthContext(record *db.UserRecord, method string, r *http.Request) *authContext {
 	// Create a new principal object with information from the database and the request.
-	principal := cerbos.NewPrincipal(username).
+	principal := cerbos.NewPrincipal(record.Username).
 		WithRoles(record.Roles...).
 		WithAttr("aisles", record.Aisles).
-		WithAttr("ipAddress", r.RemoteAddr)
+		WithAttr("ipAddress", clientIP(r)).
+		WithAttr("authMethod", method)
 
-	return &authContext{username: username, principal: principal}, nil
+	return &authContext{username: record.Username, principal: principal, method: method}
 }
 
-// isAllowed is a utility function to check each action against a Cerbos policy.
-func (s *Service) isAllowed(ctx context.Context, resource *cerbos.Resource, action string) bool {
-	authCtx := s.principalContext(ctx)
-	if authCtx == nil {
+// authorize is a utility function to check an action against a Cerbos policy. If the action is not allowed,
+// it writes a 403 response, or a 503 response if the PDP is unavailable, and returns false.
+// Every decision is recorded in the audit log.
+func (s *Service) authorize(w http.ResponseWriter, r *http.Request, resource *cerbos.Resource, action string) bool {
+	d, err := s.checkBatch(r.Context(), resourceCheck{resource: resource, actions: []string{action}})
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+
+	if !d.allowed(resource, action) {
+		writeAuthzError(w, err, http.StatusForbidden, "Operation not allowed")
 		return false
 	}
 
-	allowed, err := authCtx.IsAllowed(ctx, resource, action)
+	return true
+}
+
+// allowedActions checks all the given actions on a resource in a single request and returns the ones that are allowed.
+// If the PDP is unavailable, the actions that fail open are returned along with the error.
+func (s *Service) allowedActions(ctx context.Context, resource *cerbos.Resource, actions []string) ([]string, error) {
+	d, err := s.checkBatch(ctx, resourceCheck{resource: resource, actions: actions})
+
+	allowed := make([]string, 0, len(actions))
+	for _, action := range actions {
+		if d.allowed(resource, action) {
+			allowed = append(allowed, action)
+		}
+	}
+
+	return allowed, err
+}
+
+// maxBatchSize is the number of resources sent in each CheckResources request.
+// It matches the default request limit of the Cerbos server.
+const maxBatchSize = 50
+
+// resourceCheck is a resource and the actions to check for it as part of a batch.
+type resourceCheck struct {
+	resource *cerbos.Resource
+	actions  []string
+}
+
+type decisionKey struct {
+	kind string
+	id   string
+}
+
+// decisions holds the outcome of a batch of checks by resource and action.
+type decisions map[decisionKey]map[string]bool
+
+// allowed reports whether the action is allowed on the resource. Actions that were not checked are not allowed.
+func (d decisions) allowed(resource *cerbos.Resource, action string) bool {
+	return d[decisionKey{kind: resource.Kind(), id: resource.ID()}][action]
+}
+
+func (d decisions) set(resource *cerbos.Resource, action string, allowed bool) {
+	key := decisionKey{kind: resource.Kind(), id: resource.ID()}
+	if d[key] == nil {
+		d[key] = make(map[string]bool)
+	}
+	d[key][action] = allowed
+}
+
+// checkBatch checks the actions for many resources using as few CheckResources requests as possible.
+// Resources are identified by kind and ID, so each resource in the batch must be distinct.
+// If any request fails, the decisions of the whole batch are discarded. If the PDP is unavailable, the returned error
+// wraps errPDPUnavailable and the decisions allow only the actions that fail open; otherwise everything is denied.
+// Every decision is recorded in the audit log.
+func (s *Service) checkBatch(ctx context.Context, checks ...resourceCheck) (decisions, error) {
+	principal, err := authPrincipal(ctx)
 	if err != nil {
-		log.Printf("ERROR: %v", err)
-		return false
+		return decisions{}, err
 	}
 
-	return allowed
+	result := make(decisions, len(checks))
+
+	for chunk := range slices.Chunk(checks, maxBatchSize) {
+		batch := cerbos.NewResourceBatch()
+		for _, c := range chunk {
+			batch.Add(c.resource, c.actions...)
+		}
+
+		cctx, cancel := s.cerbosContext(ctx)
+		start := time.Now()
+		resp, err := s.authz.CheckResources(cctx, principal, batch)
+		latency := time.Since(start)
+		cancel()
+		if err != nil {
+			err = cerbosError(err)
+			// The decisions already made for earlier chunks are dropped so that callers never act on part of a batch.
+			result = s.failedDecisions(principal, checks, err)
+			for _, c := range chunk {
+				for _, action := range c.actions {
+					s.recordDecision(ctx, c.resource, action, result.allowed(c.resource, action), "", latency, err)
+				}
+			}
+			return result, err
+		}
+
+		for _, c := range chunk {
+			rr := resp.GetResource(c.resource.ID(), cerbos.MatchResourceKind(c.resource.Kind()))
+			for _, action := range c.actions {
+				allowed := rr.IsAllowed(action)
+				result.set(c.resource, action, allowed)
+				s.recordDecision(ctx, c.resource, action, allowed, resp.GetCerbosCallId(), latency, rr.Err())
+			}
+		}
+
+		s.shadowCheck(ctx, principal, chunk, result)
+	}
+
+	return result, nil
 }
 
-// principalContext retrieves the principal stored in the context by the authentication middleware.
-func (s *Service) principalContext(ctx context.Context) cerbos.PrincipalContext {
-	actx := getAuthContext(ctx)
-	if actx == nil {
-		log.Fatal("ERROR: auth context is nil")
+// failedDecisions returns the decisions for a batch of checks that failed with the given error.
+// Only the actions that fail open are allowed, and only if the PDP is unavailable.
+func (s *Service) failedDecisions(principal *cerbos.Principal, checks []resourceCheck, err error) decisions {
+	unavailable := errors.Is(err, errPDPUnavailable)
+	result := make(decisions, len(checks))
+	for _, c := range checks {
+		for _, action := range c.actions {
+			result.set(c.resource, action, unavailable && s.failsOpen(principal, c.resource, action))
+		}
 	}
 
-	return s.cerbos.WithPrincipal(actx.principal)
+	return result
+}
+
+// planResources asks Cerbos for the query plan of the resources of the given kind that the principal can act on.
+func (s *Service) planResources(ctx context.Context, resource *cerbos.Resource, action string) (*cerbos.PlanResourcesResponse, error) {
+	principal, err := authPrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cctx, cancel := s.cerbosContext(ctx)
+	defer cancel()
+
+	plan, err := s.authz.PlanResources(cctx, principal, resource, action)
+	return plan, cerbosError(err)
 }
 
 func (s *Service) handleOrderCreate(w http.ResponseWriter, r *http.Request) {
@@ -174,14 +522,32 @@ func (s *Service) handleOrderCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resource := cerbos.NewResource(orderResource, "new").WithAttr("items", order.Items)
-	if !s.isAllowed(r.Context(), resource, "CREATE") {
-		writeMessage(w, http.StatusForbidden, "Operation not allowed")
+	lines, total, err := s.priceOrder(r.Context(), order.Items)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeStockError(w, err, "Failed to create order")
+		return
+	}
+
+	resource := cerbos.NewResource(orderResource, "new").WithAttr("items", order.Items).WithAttr("total", total)
+	if !s.authorize(w, r, resource, "CREATE") {
+		return
+	}
+
+	if err := s.inventory.ReserveStock(r.Context(), nil, order.Items); err != nil {
+		log.Printf("ERROR: %v", err)
+		writeStockError(w, err, "Failed to create order")
 		return
 	}
 
 	username := getCurrentUser(r.Context())
-	orderID := s.orders.Create(username, order)
+	orderID, err := s.orders.Create(r.Context(), username, lines)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		s.releaseStock(r.Context(), order.Items)
+		writeMessage(w, http.StatusInternalServerError, "Failed to create order")
+		return
+	}
 
 	writeJSON(w, http.StatusCreated, struct {
 		OrderID uint64 `json:"orderID"`
@@ -216,21 +582,34 @@ func (s *Service) handleOrderUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !s.isAllowed(r.Context(), toOrderResource(order), "UPDATE") {
-		writeMessage(w, http.StatusForbidden, "Operation not allowed")
+	newOrder, err := readOrder(r.Body)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusBadRequest, "Bad request")
 		return
 	}
 
-	newOrder, err := readOrder(r.Body)
+	lines, newTotal, err := s.priceOrder(r.Context(), newOrder.Items)
 	if err != nil {
 		log.Printf("ERROR: %v", err)
-		writeMessage(w, http.StatusBadRequest, "Bad request")
+		writeStockError(w, err, "Failed to update order")
 		return
 	}
 
-	if err := s.orders.Update(order.ID, newOrder); err != nil {
+	resource := toOrderResource(order).WithAttr("newItems", newOrder.Items).WithAttr("newTotal", newTotal)
+	if !s.authorize(w, r, resource, "UPDATE") {
+		return
+	}
+
+	err = s.orders.Update(r.Context(), order.ID, lines, func(ctx context.Context, current db.Order) error {
+		if !sameOrder(current, order) {
+			return errOrderChanged
+		}
+		return s.inventory.ReserveStock(ctx, current.Items, newOrder.Items)
+	})
+	if err != nil {
 		log.Printf("ERROR: %v", err)
-		writeMessage(w, http.StatusInternalServerError, "Failed to update order")
+		writeStockError(w, err, "Failed to update order")
 		return
 	}
 
@@ -247,13 +626,25 @@ func (s *Service) handleOrderDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !s.isAllowed(r.Context(), toOrderResource(order), "DELETE") {
-		writeMessage(w, http.StatusForbidden, "Operation not allowed")
+	if !s.authorize(w, r, toOrderResource(order), "DELETE") {
 		return
 	}
 
-	if err := s.orders.Delete(order.ID); err != nil {
+	err = s.orders.Delete(r.Context(), order.ID, func(ctx context.Context, current db.Order) error {
+		if !sameOrder(current, order) {
+			return errOrderChanged
+		}
+		if holdsReservation(current.Status) {
+			return s.inventory.ReserveStock(ctx, current.Items, nil)
+		}
+		return nil
+	})
+	if err != nil {
 		log.Printf("ERROR: %v", err)
+		if errors.Is(err, errOrderChanged) {
+			writeMessage(w, http.StatusConflict, "Order was changed by another request")
+			return
+		}
 		writeMessage(w, http.StatusInternalServerError, "Failed to delete order")
 		return
 	}
@@ -271,12 +662,76 @@ func (s *Service) handleOrderView(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !s.isAllowed(r.Context(), toOrderResource(order), "VIEW") {
-		writeMessage(w, http.StatusForbidden, "Operation not allowed")
+	// Check all the actions at once so that clients know what else they can do with the order.
+	allowed, err := s.allowedActions(r.Context(), toOrderResource(order), orderActions)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+
+	if !slices.Contains(allowed, "VIEW") {
+		writeAuthzError(w, err, http.StatusForbidden, "Operation not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		db.Order
+		AllowedActions []string `json:"_allowedActions"`
+	}{Order: order, AllowedActions: allowed})
+}
+
+func (s *Service) handleOrderHistory(w http.ResponseWriter, r *http.Request) {
+	defer cleanup(r)
+
+	order, err := s.retrieveOrder(r)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusBadRequest, "Order not found")
+		return
+	}
+
+	if !s.authorize(w, r, toOrderResource(order), "VIEW_HISTORY") {
+		return
+	}
+
+	history, err := s.orders.History(r.Context(), order.ID)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to retrieve order history")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		History []db.HistoryEntry `json:"history"`
+	}{History: history})
+}
+
+func (s *Service) handleOrderList(w http.ResponseWriter, r *http.Request) {
+	defer cleanup(r)
+
+	plan, err := s.planResources(r.Context(), cerbos.NewResource(orderResource, ""), "VIEW")
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeAuthzError(w, err, http.StatusInternalServerError, "Failed to list orders")
+		return
+	}
+
+	pred, err := queryplan.Compile(plan.GetFilter())
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to list orders")
+		return
+	}
+
+	orders, err := s.orders.List(r.Context(), func(o db.Order) bool { return pred(o) })
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to list orders")
 		return
 	}
 
-	writeJSON(w, http.StatusOK, order)
+	writeJSON(w, http.StatusOK, struct {
+		Orders []db.Order `json:"orders"`
+	}{Orders: orders})
 }
 
 func (s *Service) handleBackofficeOrderUpdate(w http.ResponseWriter, r *http.Request) {
@@ -289,24 +744,160 @@ func (s *Service) handleBackofficeOrderUpdate(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	vars := mux.Vars(r)
-	status := vars["status"]
+	// The status is only validated once the principal is allowed to update the order so that the lifecycle errors,
+	// which include the current status, are not disclosed to anyone else.
+	newStatus := mux.Vars(r)["status"]
+	status, statusErr := db.ParseOrderStatus(newStatus)
+
+	// Picking an order takes the reserved stock off the shelves, so the principal must be allowed to
+	// pick each of the items as well. All the checks are made in a single batch.
+	resource := toOrderResource(order).WithAttr("newStatus", newStatus)
+	checks := []resourceCheck{{resource: resource, actions: []string{"UPDATE_STATUS"}}}
+	if picksStock(order.Status, status) {
+		pickChecks, err := s.pickChecks(r.Context(), order.Items)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			writeMessage(w, http.StatusInternalServerError, "Failed to update order status")
+			return
+		}
+		checks = append(checks, pickChecks...)
+	}
 
-	resource := toOrderResource(order).WithAttr("newStatus", status)
-	if !s.isAllowed(r.Context(), resource, "UPDATE_STATUS") {
-		writeMessage(w, http.StatusForbidden, "Operation not allowed")
+	authz, err := s.checkBatch(r.Context(), checks...)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeAuthzError(w, err, http.StatusForbidden, "Operation not allowed")
 		return
 	}
 
-	if err := s.orders.SetStatus(order.ID, status); err != nil {
+	for _, c := range checks {
+		if !authz.allowed(c.resource, c.actions[0]) {
+			writeMessage(w, http.StatusForbidden, "Operation not allowed")
+			return
+		}
+	}
+
+	if statusErr != nil {
+		log.Printf("ERROR: %v", statusErr)
+		writeStatusError(w, statusErr, order.Status)
+		return
+	}
+
+	if err := s.orders.SetStatus(r.Context(), order.ID, status, s.adjustStock(order, status)); err != nil {
 		log.Printf("ERROR: %v", err)
-		writeMessage(w, http.StatusInternalServerError, "Failed to update order")
+		writeStatusError(w, err, order.Status)
 		return
 	}
 
 	writeMessage(w, http.StatusOK, "Order status updated")
 }
 
+// priceOrder creates order lines priced at the current inventory prices and returns them along with the order total.
+// A *db.StockError is returned if any of the items do not exist in the inventory and db.ErrAmountOverflow
+// if the order is too expensive to be priced.
+func (s *Service) priceOrder(ctx context.Context, items map[string]uint) ([]db.OrderLine, uint64, error) {
+	lines := make([]db.OrderLine, 0, len(items))
+	var unknown []db.ShortLine
+
+	for item, qty := range items {
+		record, err := s.inventory.GetItem(ctx, item)
+		if err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				unknown = append(unknown, db.ShortLine{Item: item, Requested: qty, Unknown: true})
+				continue
+			}
+			return nil, 0, err
+		}
+
+		line, err := db.NewOrderLine(item, qty, record.Price)
+		if err != nil {
+			return nil, 0, err
+		}
+		lines = append(lines, line)
+	}
+
+	if len(unknown) > 0 {
+		sort.Slice(unknown, func(i, j int) bool { return unknown[i].Item < unknown[j].Item })
+		return nil, 0, &db.StockError{Lines: unknown}
+	}
+
+	sort.Slice(lines, func(i, j int) bool { return lines[i].Item < lines[j].Item })
+
+	total, err := db.LinesTotal(lines)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return lines, total, nil
+}
+
+// holdsReservation reports whether an order in the given status has stock reserved that has not been picked yet.
+func holdsReservation(status db.OrderStatus) bool {
+	return status == db.StatusPending || status == db.StatusPicking
+}
+
+// adjustStock returns an OrderHook that updates the stock reserved for an order as it moves to the given status,
+// provided that the order has not changed since it was authorized. Reserved stock goes back on the shelves
+// if the order is cancelled and leaves them once it has been picked.
+func (s *Service) adjustStock(order db.Order, status db.OrderStatus) db.OrderHook {
+	return func(ctx context.Context, current db.Order) error {
+		if !sameOrder(current, order) {
+			return errOrderChanged
+		}
+
+		switch {
+		case holdsReservation(current.Status) && status == db.StatusCancelled:
+			if err := s.inventory.ReserveStock(ctx, current.Items, nil); err != nil {
+				return fmt.Errorf("failed to release stock for order %d: %w", current.ID, err)
+			}
+		case picksStock(current.Status, status):
+			if err := s.inventory.PickReserved(ctx, current.Items); err != nil {
+				return fmt.Errorf("failed to pick stock for order %d: %w", current.ID, err)
+			}
+		}
+
+		return nil
+	}
+}
+
+// sameOrder reports whether the order still has the attributes that it was authorized with.
+func sameOrder(current, authorized db.Order) bool {
+	return current.Owner == authorized.Owner && current.Status == authorized.Status &&
+		current.Total == authorized.Total && maps.Equal(current.Items, authorized.Items)
+}
+
+// picksStock reports whether moving an order between the given statuses takes its reserved stock out of the inventory.
+func picksStock(from, to db.OrderStatus) bool {
+	return holdsReservation(from) && !holdsReservation(to) && to != db.StatusCancelled
+}
+
+// pickChecks returns the checks needed to pick the given items from the inventory.
+// Items that are no longer in the inventory have nothing to pick and are left out.
+func (s *Service) pickChecks(ctx context.Context, items map[string]uint) ([]resourceCheck, error) {
+	checks := make([]resourceCheck, 0, len(items))
+	for item, qty := range items {
+		record, err := s.inventory.GetItem(ctx, item)
+		if err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+
+		resource := toInventoryResource(record).WithAttr("pickQuantity", qty)
+		checks = append(checks, resourceCheck{resource: resource, actions: []string{"PICK"}})
+	}
+
+	return checks, nil
+}
+
+// releaseStock returns the stock reserved for the given items to the inventory.
+func (s *Service) releaseStock(ctx context.Context, items map[string]uint) {
+	if err := s.inventory.ReserveStock(ctx, items, nil); err != nil {
+		log.Printf("ERROR: failed to release stock: %v", err)
+	}
+}
+
 func (s *Service) retrieveOrder(r *http.Request) (db.Order, error) {
 	vars := mux.Vars(r)
 
@@ -315,7 +906,7 @@ func (s *Service) retrieveOrder(r *http.Request) (db.Order, error) {
 		return db.Order{}, err
 	}
 
-	return s.orders.Get(orderID)
+	return s.orders.Get(r.Context(), orderID)
 }
 
 func (s *Service) handleInventoryAdd(w http.ResponseWriter, r *http.Request) {
@@ -329,12 +920,11 @@ func (s *Service) handleInventoryAdd(w http.ResponseWriter, r *http.Request) {
 	}
 
 	resource := cerbos.NewResource(inventoryResource, "new").WithAttr("aisle", item.Aisle)
-	if !s.isAllowed(r.Context(), resource, "CREATE") {
-		writeMessage(w, http.StatusForbidden, "Operation not allowed")
+	if !s.authorize(w, r, resource, "CREATE") {
 		return
 	}
 
-	if err := s.inventory.Add(item); err != nil {
+	if err := s.inventory.Add(r.Context(), item); err != nil {
 		log.Printf("ERROR: %v", err)
 		writeMessage(w, http.StatusBadRequest, "Bad request")
 		return
@@ -361,12 +951,11 @@ func (s *Service) handleInventoryUpdate(w http.ResponseWriter, r *http.Request)
 	}
 
 	resource := toInventoryResource(record).WithAttr("newAisle", item.Aisle).WithAttr("newPrice", item.Price)
-	if !s.isAllowed(r.Context(), resource, "UPDATE") {
-		writeMessage(w, http.StatusForbidden, "Operation not allowed")
+	if !s.authorize(w, r, resource, "UPDATE") {
 		return
 	}
 
-	if err := s.inventory.Update(item); err != nil {
+	if err := s.inventory.Update(r.Context(), item); err != nil {
 		log.Printf("ERROR: %v", err)
 		writeMessage(w, http.StatusInternalServerError, "Failed to update item")
 		return
@@ -386,12 +975,11 @@ func (s *Service) handleInventoryDelete(w http.ResponseWriter, r *http.Request)
 	}
 
 	resource := toInventoryResource(record)
-	if !s.isAllowed(r.Context(), resource, "DELETE") {
-		writeMessage(w, http.StatusForbidden, "Operation not allowed")
+	if !s.authorize(w, r, resource, "DELETE") {
 		return
 	}
 
-	if err := s.inventory.Delete(record.ID); err != nil {
+	if err := s.inventory.Delete(r.Context(), record.ID); err != nil {
 		log.Printf("ERROR: %v", err)
 		writeMessage(w, http.StatusInternalServerError, "Failed to delete item")
 		return
@@ -410,13 +998,59 @@ func (s *Service) handleInventoryGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resource := toInventoryResource(record)
-	if !s.isAllowed(r.Context(), resource, "VIEW") {
-		writeMessage(w, http.StatusForbidden, "Operation not allowed")
+	// Check all the actions at once so that clients know what else they can do with the item.
+	// UPDATE is checked as if the item was saved unchanged.
+	resource := toInventoryResource(record).WithAttr("newAisle", record.Aisle).WithAttr("newPrice", record.Price)
+	allowed, err := s.allowedActions(r.Context(), resource, inventoryActions)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+
+	if !slices.Contains(allowed, "VIEW") {
+		writeAuthzError(w, err, http.StatusForbidden, "Operation not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		db.InventoryRecord
+		AllowedActions []string `json:"_allowedActions"`
+	}{InventoryRecord: record, AllowedActions: allowed})
+}
+
+func (s *Service) handleInventoryList(w http.ResponseWriter, r *http.Request) {
+	defer cleanup(r)
+
+	filter, err := readInventoryFilter(r.URL.Query())
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusBadRequest, "Invalid filter")
+		return
+	}
+
+	plan, err := s.planResources(r.Context(), cerbos.NewResource(inventoryResource, ""), "VIEW")
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeAuthzError(w, err, http.StatusInternalServerError, "Failed to list items")
+		return
+	}
+
+	pred, err := queryplan.Compile(plan.GetFilter())
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to list items")
+		return
+	}
+
+	items, err := s.inventory.List(r.Context(), func(i db.InventoryRecord) bool { return filter.matches(i) && pred(i) })
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to list items")
 		return
 	}
 
-	writeJSON(w, http.StatusOK, record)
+	writeJSON(w, http.StatusOK, struct {
+		Items []db.InventoryRecord `json:"items"`
+	}{Items: items})
 }
 
 func (s *Service) handleInventoryPick(w http.ResponseWriter, r *http.Request) {
@@ -438,14 +1072,17 @@ func (s *Service) handleInventoryPick(w http.ResponseWriter, r *http.Request) {
 	}
 
 	resource := toInventoryResource(record).WithAttr("pickQuantity", pickQty)
-	if !s.isAllowed(r.Context(), resource, "PICK") {
-		writeMessage(w, http.StatusForbidden, "Operation not allowed")
+	if !s.authorize(w, r, resource, "PICK") {
 		return
 	}
 
-	newQty, err := s.inventory.UpdateQuantity(record.ID, -pickQty)
+	newQty, err := s.inventory.UpdateQuantity(r.Context(), record.ID, -pickQty)
 	if err != nil {
 		log.Printf("ERROR: %v", err)
+		if errors.Is(err, db.ErrNoStock) {
+			writeMessage(w, http.StatusConflict, "Insufficient stock")
+			return
+		}
 		writeMessage(w, http.StatusInternalServerError, "Failed to update item")
 		return
 	}
@@ -474,12 +1111,11 @@ func (s *Service) handleInventoryReplenish(w http.ResponseWriter, r *http.Reques
 	}
 
 	resource := toInventoryResource(record).WithAttr("newQuantity", qty)
-	if !s.isAllowed(r.Context(), resource, "REPLENISH") {
-		writeMessage(w, http.StatusForbidden, "Operation not allowed")
+	if !s.authorize(w, r, resource, "REPLENISH") {
 		return
 	}
 
-	newQty, err := s.inventory.UpdateQuantity(record.ID, qty)
+	newQty, err := s.inventory.UpdateQuantity(r.Context(), record.ID, qty)
 	if err != nil {
 		log.Printf("ERROR: %v", err)
 		writeMessage(w, http.StatusInternalServerError, "Failed to update item")
@@ -494,7 +1130,7 @@ func (s *Service) handleInventoryReplenish(w http.ResponseWriter, r *http.Reques
 func (s *Service) retrieveInventoryRecord(r *http.Request) (db.InventoryRecord, error) {
 	vars := mux.Vars(r)
 
-	return s.inventory.GetItem(vars["itemID"])
+	return s.inventory.GetItem(r.Context(), vars["itemID"])
 }
 
 func (s *Service) handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -510,13 +1146,24 @@ func cleanup(r *http.Request) {
 	}
 }
 
+// maxItemQuantity is the largest quantity of a single item that can be ordered.
+const maxItemQuantity = 10000
+
 func readOrder(r io.Reader) (db.CustomerOrder, error) {
 	dec := json.NewDecoder(r)
 
 	var order db.CustomerOrder
-	err := dec.Decode(&order)
+	if err := dec.Decode(&order); err != nil {
+		return order, err
+	}
 
-	return order, err
+	for item, qty := range order.Items {
+		if qty == 0 || qty > maxItemQuantity {
+			return order, fmt.Errorf("invalid quantity %d of %s", qty, item)
+		}
+	}
+
+	return order, nil
 }
 
 func readInventoryItem(r io.Reader) (db.InventoryItem, error) {
@@ -528,6 +1175,69 @@ func readInventoryItem(r io.Reader) (db.InventoryItem, error) {
 	return item, err
 }
 
+// inventoryFilter holds the search criteria accepted by the inventory listing endpoint.
+type inventoryFilter struct {
+	aisles      map[string]struct{}
+	minPrice    *uint64
+	maxPrice    *uint64
+	minQuantity *int
+	maxQuantity *int
+}
+
+func (f inventoryFilter) matches(i db.InventoryRecord) bool {
+	if len(f.aisles) > 0 {
+		if _, ok := f.aisles[i.Aisle]; !ok {
+			return false
+		}
+	}
+
+	switch {
+	case f.minPrice != nil && i.Price < *f.minPrice:
+		return false
+	case f.maxPrice != nil && i.Price > *f.maxPrice:
+		return false
+	case f.minQuantity != nil && i.Quantity < *f.minQuantity:
+		return false
+	case f.maxQuantity != nil && i.Quantity > *f.maxQuantity:
+		return false
+	}
+
+	return true
+}
+
+func readInventoryFilter(q url.Values) (inventoryFilter, error) {
+	var f inventoryFilter
+
+	if aisles := q["aisle"]; len(aisles) > 0 {
+		f.aisles = make(map[string]struct{}, len(aisles))
+		for _, a := range aisles {
+			f.aisles[a] = struct{}{}
+		}
+	}
+
+	for param, dest := range map[string]**uint64{"minPrice": &f.minPrice, "maxPrice": &f.maxPrice} {
+		if v := q.Get(param); v != "" {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return f, fmt.Errorf("invalid %s: %w", param, err)
+			}
+			*dest = &n
+		}
+	}
+
+	for param, dest := range map[string]**int{"minQuantity": &f.minQuantity, "maxQuantity": &f.maxQuantity} {
+		if v := q.Get(param); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return f, fmt.Errorf("invalid %s: %w", param, err)
+			}
+			*dest = &n
+		}
+	}
+
+	return f, nil
+}
+
 type genericResponse struct {
 	Message string `json:"message"`
 }
@@ -536,6 +1246,70 @@ func writeMessage(w http.ResponseWriter, code int, msg string) {
 	writeJSON(w, code, genericResponse{Message: msg})
 }
 
+// writeStockError writes a structured response listing the short lines if err is a stock error, a 400 response
+// if a quantity or the order total is invalid and a generic server error with the given message otherwise.
+func writeStockError(w http.ResponseWriter, err error, msg string) {
+	if errors.Is(err, db.ErrInvalidQuantity) {
+		writeMessage(w, http.StatusBadRequest, "Invalid quantity")
+		return
+	}
+
+	if errors.Is(err, db.ErrAmountOverflow) {
+		writeMessage(w, http.StatusBadRequest, "Order total is too large")
+		return
+	}
+
+	if errors.Is(err, errOrderChanged) {
+		writeMessage(w, http.StatusConflict, "Order was changed by another request")
+		return
+	}
+
+	var stockErr *db.StockError
+	if !errors.As(err, &stockErr) {
+		writeMessage(w, http.StatusInternalServerError, msg)
+		return
+	}
+
+	writeJSON(w, http.StatusConflict, struct {
+		Message    string         `json:"message"`
+		ShortLines []db.ShortLine `json:"shortLines"`
+	}{Message: "Insufficient stock", ShortLines: stockErr.Lines})
+}
+
+// writeStatusError writes a response listing the statuses that an order in the current status can move to
+// if err is an invalid status or transition error and a generic server error otherwise.
+func writeStatusError(w http.ResponseWriter, err error, current db.OrderStatus) {
+	var code int
+	var msg string
+	switch {
+	case errors.Is(err, db.ErrInvalidStatus):
+		code, msg = http.StatusUnprocessableEntity, "Invalid order status"
+	case errors.Is(err, db.ErrInvalidTransition):
+		code, msg = http.StatusConflict, "Invalid order status transition"
+	case errors.Is(err, db.ErrNotFound):
+		writeMessage(w, http.StatusBadRequest, "Order not found")
+		return
+	case errors.Is(err, errOrderChanged):
+		writeMessage(w, http.StatusConflict, "Order was changed by another request")
+		return
+	default:
+		writeMessage(w, http.StatusInternalServerError, "Failed to update order")
+		return
+	}
+
+	// Prefer the statuses reported by the store as the order may have changed since it was retrieved.
+	allowed := current.NextStatuses()
+	var transitionErr *db.TransitionError
+	if errors.As(err, &transitionErr) {
+		allowed = transitionErr.Allowed
+	}
+
+	writeJSON(w, code, struct {
+		Message         string           `json:"message"`
+		AllowedStatuses []db.OrderStatus `json:"allowedStatuses"`
+	}{Message: msg, AllowedStatuses: allowed})
+}
+
 func writeJSON(w http.ResponseWriter, code int, v interface{}) {
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(code)
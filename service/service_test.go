@@ -0,0 +1,282 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cerbos/cerbos-sdk-go/cerbos"
+	"github.com/cerbos/demo-rest/db"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestService(t *testing.T, authz Authorizer, opts ...Option) *Service {
+	t.Helper()
+
+	s, err := New("", InMemoryStores(), append([]Option{WithAuthorizer(authz)}, opts...)...)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	return s
+}
+
+// do sends a request to the handler authenticated as the given user, or unauthenticated if user is empty.
+func do(t *testing.T, h http.Handler, user, method, path string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("Failed to marshal request: %v", err)
+		}
+		r = strings.NewReader(string(b))
+	}
+
+	req := httptest.NewRequest(method, path, r)
+	if user != "" {
+		req.SetBasicAuth(user, user+"sStrongPassword")
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func decode[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+
+	var v T
+	if err := json.NewDecoder(rec.Body).Decode(&v); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	return v
+}
+
+// failingAuthorizer lets the first calls to CheckResources through to a FakeAuthorizer and fails the rest.
+type failingAuthorizer struct {
+	*FakeAuthorizer
+	mu    sync.Mutex
+	calls int
+	after int
+	err   error
+}
+
+func (a *failingAuthorizer) CheckResources(ctx context.Context, principal *cerbos.Principal, batch *cerbos.ResourceBatch) (*cerbos.CheckResourcesResponse, error) {
+	a.mu.Lock()
+	a.calls++
+	fail := a.calls > a.after
+	a.mu.Unlock()
+
+	if fail {
+		return nil, a.err
+	}
+
+	return a.FakeAuthorizer.CheckResources(ctx, principal, batch)
+}
+
+func TestBulkOrderUpdateDeniesWholeBatchOnError(t *testing.T) {
+	// The first chunk of checks is allowed and the second one fails.
+	authz := &failingAuthorizer{FakeAuthorizer: NewFakeAuthorizer().Allow("*", "*", "*"), after: 1, err: errors.New("bad request")}
+	s := newTestService(t, authz)
+
+	ctx := context.Background()
+	var ids []uint64
+	for range maxBatchSize + 10 {
+		id, err := s.orders.Create(ctx, "adam", nil)
+		if err != nil {
+			t.Fatalf("Failed to create order: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	rec := do(t, s.Handler(), "bella", http.MethodPost, "/backoffice/orders/status", bulkStatusUpdate{OrderIDs: ids, Status: string(db.StatusPicking)})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	resp := decode[struct {
+		Results []bulkStatusResult `json:"results"`
+	}](t, rec)
+	if len(resp.Results) != len(ids) {
+		t.Fatalf("Expected %d results, got %d", len(ids), len(resp.Results))
+	}
+
+	for _, r := range resp.Results {
+		if r.Result != bulkResultForbidden {
+			t.Errorf("Expected order %d to be %s, got %s", r.OrderID, bulkResultForbidden, r.Result)
+		}
+
+		o, err := s.orders.Get(ctx, r.OrderID)
+		if err != nil {
+			t.Fatalf("Failed to get order: %v", err)
+		}
+		if o.Status != db.StatusPending {
+			t.Errorf("Expected order %d to be %s, got %s", r.OrderID, db.StatusPending, o.Status)
+		}
+	}
+}
+
+func TestMissingAuthContext(t *testing.T) {
+	// The handlers are called without the authentication middleware, so there is no principal to check.
+	authz := NewFakeAuthorizer().Allow("*", "*", "*")
+	conf := DefaultCerbosConfig
+	conf.FailMode = FailOpenReads
+	s := newTestService(t, authz, WithCerbosConfig(conf))
+
+	id, err := s.orders.Create(context.Background(), "adam", nil)
+	if err != nil {
+		t.Fatalf("Failed to create order: %v", err)
+	}
+
+	testCases := map[string]http.HandlerFunc{
+		"order view":    s.handleOrderView,
+		"order history": s.handleOrderHistory,
+		"order list":    s.handleOrderList,
+	}
+
+	for name, handler := range testCases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req = mux.SetURLVars(req, map[string]string{"orderID": strconv.FormatUint(id, 10)})
+
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != http.StatusInternalServerError {
+				t.Fatalf("Expected status 500, got %d: %s", rec.Code, rec.Body)
+			}
+
+			if got := decode[struct {
+				Message string `json:"message"`
+			}](t, rec); got.Message != "Internal server error" {
+				t.Errorf("Expected message %q, got %q", "Internal server error", got.Message)
+			}
+		})
+	}
+
+	if calls := authz.Calls(); len(calls) != 0 {
+		t.Errorf("Expected no requests to the authorizer, got %+v", calls)
+	}
+}
+
+func TestDecisionCacheIgnoresClientPort(t *testing.T) {
+	authz := NewFakeAuthorizer().Allow("*", "*", "*")
+	conf := DefaultDecisionCacheConfig
+	conf.TTL = time.Minute
+	s := newTestService(t, authz, WithDecisionCache(conf))
+
+	if err := s.inventory.Add(context.Background(), db.InventoryItem{ID: "eggs", Aisle: "dairy", Price: 30}); err != nil {
+		t.Fatalf("Failed to add item: %v", err)
+	}
+
+	h := s.Handler()
+	for _, addr := range []string{"192.0.2.1:40001", "192.0.2.1:40002"} {
+		req := httptest.NewRequest(http.MethodGet, "/backoffice/inventory/eggs", nil)
+		req.RemoteAddr = addr
+		req.SetBasicAuth("bella", "bellasStrongPassword")
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body)
+		}
+	}
+
+	// The other actions change the item, so they bypass the cache.
+	views := 0
+	for _, c := range authz.Calls() {
+		if slices.Contains(c.Actions, "VIEW") {
+			views++
+		}
+	}
+	if views != 1 {
+		t.Errorf("Expected the second VIEW check to be answered from the cache, got %d requests to the authorizer", views)
+	}
+}
+
+func TestOrderStatusLifecycleIsCheckedAfterAuthorization(t *testing.T) {
+	authz := NewFakeAuthorizer().Allow("bella", "*", "*")
+	s := newTestService(t, authz)
+
+	if _, err := s.orders.Create(context.Background(), "adam", nil); err != nil {
+		t.Fatalf("Failed to create order: %v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		user     string
+		path     string
+		body     any
+		wantCode int
+	}{
+		{name: "unauthorized unknown status", user: "adam", path: "/backoffice/order/1/status/BANANA", wantCode: http.StatusForbidden},
+		{name: "unauthorized invalid transition", user: "adam", path: "/backoffice/order/1/status/DISPATCHED", wantCode: http.StatusForbidden},
+		{name: "authorized unknown status", user: "bella", path: "/backoffice/order/1/status/BANANA", wantCode: http.StatusUnprocessableEntity},
+		{name: "authorized invalid transition", user: "bella", path: "/backoffice/order/1/status/DISPATCHED", wantCode: http.StatusConflict},
+		{
+			name: "unauthorized bulk unknown status", user: "adam", path: "/backoffice/orders/status",
+			body: bulkStatusUpdate{OrderIDs: []uint64{1}, Status: "BANANA"}, wantCode: http.StatusForbidden,
+		},
+		{
+			name: "authorized bulk unknown status", user: "bella", path: "/backoffice/orders/status",
+			body: bulkStatusUpdate{OrderIDs: []uint64{1}, Status: "BANANA"}, wantCode: http.StatusUnprocessableEntity,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := do(t, s.Handler(), tc.user, http.MethodPost, tc.path, tc.body)
+			if rec.Code != tc.wantCode {
+				t.Fatalf("Expected status %d, got %d: %s", tc.wantCode, rec.Code, rec.Body)
+			}
+
+			if tc.wantCode == http.StatusForbidden && strings.Contains(rec.Body.String(), "allowedStatuses") {
+				t.Errorf("Expected the allowed statuses to be withheld, got %s", rec.Body)
+			}
+		})
+	}
+}
+
+func TestDecisionCacheSkipsFallbackDecisions(t *testing.T) {
+	// The PDP is down and the fallback allows everything. Once the PDP is back, it denies everything.
+	pdp := NewFakeAuthorizer().Fail(status.Error(codes.Unavailable, "connection refused"))
+	fallback := NewFakeAuthorizer().Allow("*", "*", "*")
+	conf := DefaultDecisionCacheConfig
+	conf.TTL = time.Minute
+	s := newTestService(t, pdp, WithDecisionCache(conf), func(s *Service) { s.localFallback = fallback })
+
+	if err := s.inventory.Add(context.Background(), db.InventoryItem{ID: "eggs", Aisle: "dairy", Price: 30}); err != nil {
+		t.Fatalf("Failed to add item: %v", err)
+	}
+
+	h := s.Handler()
+	if rec := do(t, h, "bella", http.MethodGet, "/backoffice/inventory/eggs", nil); rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 from the fallback, got %d: %s", rec.Code, rec.Body)
+	}
+
+	pdp.Fail(nil)
+	if rec := do(t, h, "bella", http.MethodGet, "/backoffice/inventory/eggs", nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected status 403 from the recovered PDP, got %d: %s", rec.Code, rec.Body)
+	}
+
+	if calls := fallback.Calls(); len(calls) != 1 {
+		t.Errorf("Expected one request to the fallback, got %+v", calls)
+	}
+}
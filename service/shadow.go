@@ -0,0 +1,166 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync/atomic"
+
+	"github.com/cerbos/cerbos-sdk-go/cerbos"
+	enginev1 "github.com/cerbos/cerbos/api/genpb/cerbos/engine/v1"
+	"github.com/cerbos/demo-rest/audit"
+	"google.golang.org/protobuf/proto"
+)
+
+// defaultShadowMaxInFlight is the number of shadow evaluations that can run at the same time if ShadowConfig.MaxInFlight is not set.
+const defaultShadowMaxInFlight = 64
+
+// ShadowConfig configures shadow evaluation, which checks every authorization request a second time against another
+// policy version or scope to find out which decisions would change before the policies are rolled out.
+type ShadowConfig struct {
+	// PolicyVersion and Scope are set on the resources sent for shadow evaluation. Empty fields are left as they are.
+	PolicyVersion string
+	Scope         string
+	// ResourceKinds limits shadow evaluation to the given kinds of resources. Every kind is evaluated if it is empty.
+	ResourceKinds []string
+	// MaxInFlight is the number of shadow evaluations that can run at the same time. Further checks are skipped
+	// rather than queued so that a slow PDP cannot hold on to requests.
+	MaxInFlight int
+}
+
+// ShadowStats are the counters of shadow evaluation. Each action checked counts once.
+type ShadowStats struct {
+	Checks     uint64 `json:"checks"`
+	Mismatches uint64 `json:"mismatches"`
+	Errors     uint64 `json:"errors"`
+	Skipped    uint64 `json:"skipped"`
+}
+
+type shadowEvaluator struct {
+	conf ShadowConfig
+	// authz is the Cerbos PDP that holds the shadow policies. Shadow checks never go through the decision cache or
+	// the local fallback, which only know about the enforced policies.
+	authz      Authorizer
+	slots      chan struct{}
+	checks     atomic.Uint64
+	mismatches atomic.Uint64
+	errors     atomic.Uint64
+	skipped    atomic.Uint64
+}
+
+// shadowDecision is an enforced decision waiting to be compared with the shadow one.
+type shadowDecision struct {
+	resource *cerbos.Resource
+	action   string
+	allowed  bool
+}
+
+// WithShadowEvaluation evaluates every check again in the background against the policy version or scope in conf
+// and reports the decisions that differ from the enforced ones. Shadow decisions never affect the responses.
+// Query plans are not shadowed. The shadow policies must be deployed to the Cerbos PDP, so New fails if policies are
+// evaluated in-process only.
+func WithShadowEvaluation(conf ShadowConfig) Option {
+	return func(s *Service) {
+		if conf.MaxInFlight <= 0 {
+			conf.MaxInFlight = defaultShadowMaxInFlight
+		}
+		s.shadow = &shadowEvaluator{conf: conf, slots: make(chan struct{}, conf.MaxInFlight)}
+	}
+}
+
+func (e *shadowEvaluator) applies(kind string) bool {
+	return len(e.conf.ResourceKinds) == 0 || slices.Contains(e.conf.ResourceKinds, kind)
+}
+
+// shadowResource returns a copy of the resource with the shadow policy version and scope.
+func (e *shadowEvaluator) shadowResource(resource *cerbos.Resource) *cerbos.Resource {
+	r := &cerbos.Resource{Obj: proto.Clone(resource.Obj).(*enginev1.Resource)}
+	if e.conf.PolicyVersion != "" {
+		r = r.WithPolicyVersion(e.conf.PolicyVersion)
+	}
+	if e.conf.Scope != "" {
+		r = r.WithScope(e.conf.Scope)
+	}
+
+	return r
+}
+
+func (e *shadowEvaluator) stats() ShadowStats {
+	return ShadowStats{Checks: e.checks.Load(), Mismatches: e.mismatches.Load(), Errors: e.errors.Load(), Skipped: e.skipped.Load()}
+}
+
+// shadowCheck compares the enforced decisions of a batch with the decisions of the shadow policies in the background.
+// It returns immediately and nothing it does is reported to the caller.
+func (s *Service) shadowCheck(ctx context.Context, principal *cerbos.Principal, checks []resourceCheck, enforced decisions) {
+	e := s.shadow
+	if e == nil {
+		return
+	}
+
+	// The enforced decisions are copied because the caller keeps adding to them.
+	var pending []shadowDecision
+	batch := cerbos.NewResourceBatch()
+	for _, c := range checks {
+		if !e.applies(c.resource.Kind()) {
+			continue
+		}
+
+		for _, action := range c.actions {
+			pending = append(pending, shadowDecision{resource: c.resource, action: action, allowed: enforced.allowed(c.resource, action)})
+		}
+		batch.Add(e.shadowResource(c.resource), c.actions...)
+	}
+
+	if len(pending) == 0 {
+		return
+	}
+
+	select {
+	case e.slots <- struct{}{}:
+	default:
+		e.skipped.Add(uint64(len(pending)))
+		return
+	}
+
+	// The evaluation must outlive the request, but it keeps the auth context and request ID of the original context.
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		defer func() { <-e.slots }()
+
+		cctx, cancel := s.cerbosContext(ctx)
+		defer cancel()
+
+		resp, err := e.authz.CheckResources(cctx, principal, batch)
+		if err != nil {
+			e.errors.Add(uint64(len(pending)))
+			log.Printf("ERROR: shadow evaluation failed for request %s: %v", getRequestID(ctx), err)
+			return
+		}
+
+		for _, d := range pending {
+			rr := resp.GetResource(d.resource.ID(), cerbos.MatchResourceKind(d.resource.Kind()))
+			if err := rr.Err(); err != nil {
+				e.errors.Add(1)
+				log.Printf("ERROR: shadow evaluation failed for request %s: %v", getRequestID(ctx), err)
+				continue
+			}
+
+			e.checks.Add(1)
+			if allowed := rr.IsAllowed(d.action); allowed != d.allowed {
+				e.mismatches.Add(1)
+				log.Printf("WARNING: Shadow decision differs for request %s: principal=%s resource=%s:%s action=%s enforced=%s shadow=%s",
+					getRequestID(ctx), principal.ID(), d.resource.Kind(), d.resource.ID(), d.action, effectName(d.allowed), effectName(allowed))
+			}
+		}
+	}()
+}
+
+func effectName(allowed bool) string {
+	if allowed {
+		return audit.EffectAllow
+	}
+	return audit.EffectDeny
+}
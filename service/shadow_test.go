@@ -0,0 +1,58 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShadowMismatchesAreCounted(t *testing.T) {
+	enforced := NewFakeAuthorizer().Allow("*", "*", "*")
+	shadow := NewFakeAuthorizer().Allow("*", "*", "*").Deny("*", "order", "UPDATE")
+	s := newTestService(t, enforced,
+		WithShadowEvaluation(ShadowConfig{PolicyVersion: "next"}),
+		func(s *Service) { s.shadow.authz = shadow },
+	)
+
+	if _, err := s.orders.Create(context.Background(), "adam", nil); err != nil {
+		t.Fatalf("Failed to create order: %v", err)
+	}
+
+	rec := do(t, s.Handler(), "adam", http.MethodGet, "/store/order/1", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// Shadow checks run in the background.
+	deadline := time.Now().Add(5 * time.Second)
+	var stats ShadowStats
+	for {
+		if stats = s.shadow.stats(); stats.Checks+stats.Errors >= uint64(len(orderActions)) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	want := ShadowStats{Checks: uint64(len(orderActions)), Mismatches: 1}
+	if stats != want {
+		t.Errorf("Expected %+v, got %+v", want, stats)
+	}
+
+	if calls := enforced.Calls(); len(calls) != 1 {
+		t.Errorf("Expected one request to the enforced authorizer, got %+v", calls)
+	}
+	if calls := shadow.Calls(); len(calls) != 1 {
+		t.Errorf("Expected one request to the shadow authorizer, got %+v", calls)
+	}
+}
+
+func TestShadowEvaluationNeedsPDP(t *testing.T) {
+	_, err := New("", InMemoryStores(), WithAuthorizer(NewFakeAuthorizer()), WithShadowEvaluation(ShadowConfig{Scope: "next"}))
+	if err == nil {
+		t.Error("Expected shadow evaluation without the Cerbos PDP to fail")
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	"context"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cerbos/demo-rest/lockout"
+)
+
+// WithLoginThrottling sets the trackers used to throttle failed authentication attempts by username and by client IP address.
+func WithLoginThrottling(accounts, clients lockout.Tracker) Option {
+	return func(s *Service) {
+		s.accountAttempts = accounts
+		s.clientAttempts = clients
+	}
+}
+
+// clientIP returns the IP address of the client that sent the request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// retryAfter returns how long the client must wait before it can try to authenticate with the given key.
+// Requests are let through if the tracker fails so that an outage does not lock everybody out.
+func (s *Service) retryAfter(ctx context.Context, t lockout.Tracker, key string) time.Duration {
+	wait, err := t.Blocked(ctx, key)
+	if err != nil {
+		log.Printf("ERROR: failed to check failed login attempts: %v", err)
+		return 0
+	}
+
+	return wait
+}
+
+func (s *Service) recordFailure(ctx context.Context, t lockout.Tracker, key string) {
+	if _, err := t.Fail(ctx, key); err != nil {
+		log.Printf("ERROR: failed to record failed login attempt: %v", err)
+	}
+}
+
+func (s *Service) resetFailures(ctx context.Context, t lockout.Tracker, key string) {
+	if err := t.Reset(ctx, key); err != nil {
+		log.Printf("ERROR: failed to reset failed login attempts: %v", err)
+	}
+}
+
+func writeTooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeMessage(w, http.StatusTooManyRequests, "Too many failed attempts")
+}
+
+func (s *Service) handleUserUnlock(w http.ResponseWriter, r *http.Request) {
+	defer cleanup(r)
+
+	user, err := s.retrieveUser(r)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusBadRequest, "User not found")
+		return
+	}
+
+	if !s.authorize(w, r, toUserResource(*user), "UNLOCK") {
+		return
+	}
+
+	if err := s.accountAttempts.Reset(r.Context(), user.Username); err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to unlock user")
+		return
+	}
+
+	writeMessage(w, http.StatusOK, "User unlocked")
+}
@@ -0,0 +1,340 @@
+// Copyright 2021 Zenauth Ltd.
+// SPDX-License-Identifier: Apache-2.0
+
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/cerbos/cerbos-sdk-go/cerbos"
+	"github.com/cerbos/demo-rest/db"
+	"github.com/cerbos/demo-rest/queryplan"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const userResource = "user"
+
+// toUserResource creates a Cerbos resource from the given user record.
+func toUserResource(u db.UserRecord) *cerbos.Resource {
+	return cerbos.NewResource(userResource, u.Username).
+		WithAttr("username", u.Username).
+		WithAttr("roles", u.Roles).
+		WithAttr("aisles", u.Aisles).
+		WithAttr("disabled", u.Disabled)
+}
+
+// userView is the representation of a user returned by the API. It never includes the password hash.
+type userView struct {
+	Username string   `json:"username"`
+	Roles    []string `json:"roles"`
+	Aisles   []string `json:"aisles,omitempty"`
+	Disabled bool     `json:"disabled"`
+}
+
+func toUserView(u db.UserRecord) userView {
+	return userView{Username: u.Username, Roles: u.Roles, Aisles: u.Aisles, Disabled: u.Disabled}
+}
+
+// newUser is the request body for creating a user.
+type newUser struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Roles    []string `json:"roles"`
+	Aisles   []string `json:"aisles"`
+}
+
+// userUpdate is the request body for updating a user. Fields that are omitted are left unchanged.
+type userUpdate struct {
+	Roles  *[]string `json:"roles"`
+	Aisles *[]string `json:"aisles"`
+}
+
+func (s *Service) handleUserList(w http.ResponseWriter, r *http.Request) {
+	defer cleanup(r)
+
+	plan, err := s.planResources(r.Context(), cerbos.NewResource(userResource, ""), "VIEW")
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeAuthzError(w, err, http.StatusInternalServerError, "Failed to list users")
+		return
+	}
+
+	pred, err := queryplan.Compile(plan.GetFilter())
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to list users")
+		return
+	}
+
+	records, err := s.users.ListUsers(r.Context(), func(u db.UserRecord) bool { return pred(u) })
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to list users")
+		return
+	}
+
+	users := make([]userView, len(records))
+	for i, u := range records {
+		users[i] = toUserView(u)
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Users []userView `json:"users"`
+	}{Users: users})
+}
+
+func (s *Service) handleUserCreate(w http.ResponseWriter, r *http.Request) {
+	defer cleanup(r)
+
+	var nu newUser
+	if err := readJSON(r.Body, &nu); err != nil || nu.Username == "" || nu.Password == "" {
+		log.Printf("ERROR: invalid user: %v", err)
+		writeMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+
+	rec := db.UserRecord{Username: nu.Username, Roles: nu.Roles, Aisles: nu.Aisles}
+	if !s.authorize(w, r, toUserResource(rec), "CREATE") {
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(nu.Password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to create user")
+		return
+	}
+	rec.PasswordHash = hash
+
+	if err := s.users.CreateUser(r.Context(), rec); err != nil {
+		log.Printf("ERROR: %v", err)
+		if errors.Is(err, db.ErrAlreadyExists) {
+			writeMessage(w, http.StatusConflict, "User already exists")
+			return
+		}
+		writeMessage(w, http.StatusInternalServerError, "Failed to create user")
+		return
+	}
+
+	writeMessage(w, http.StatusCreated, "User created")
+}
+
+func (s *Service) handleUserView(w http.ResponseWriter, r *http.Request) {
+	defer cleanup(r)
+
+	user, err := s.retrieveUser(r)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusBadRequest, "User not found")
+		return
+	}
+
+	if !s.authorize(w, r, toUserResource(*user), "VIEW") {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, toUserView(*user))
+}
+
+func (s *Service) handleUserUpdate(w http.ResponseWriter, r *http.Request) {
+	defer cleanup(r)
+
+	user, err := s.retrieveUser(r)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusBadRequest, "User not found")
+		return
+	}
+
+	var upd userUpdate
+	if err := readJSON(r.Body, &upd); err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+
+	resource := toUserResource(*user)
+	if upd.Roles != nil {
+		resource = resource.WithAttr("newRoles", *upd.Roles)
+		if !s.authorize(w, r, resource, "ASSIGN_ROLES") {
+			return
+		}
+	}
+
+	if upd.Aisles != nil {
+		resource = resource.WithAttr("newAisles", *upd.Aisles)
+		if !s.authorize(w, r, resource, "SET_AISLES") {
+			return
+		}
+	}
+
+	err = s.users.UpdateUser(r.Context(), user.Username, func(u *db.UserRecord) {
+		if upd.Roles != nil {
+			u.Roles = *upd.Roles
+		}
+
+		if upd.Aisles != nil {
+			u.Aisles = *upd.Aisles
+		}
+	})
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to update user")
+		return
+	}
+
+	s.invalidateCredentials(user.Username)
+
+	writeMessage(w, http.StatusOK, "User updated")
+}
+
+func (s *Service) handleUserResetPassword(w http.ResponseWriter, r *http.Request) {
+	defer cleanup(r)
+
+	user, err := s.retrieveUser(r)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusBadRequest, "User not found")
+		return
+	}
+
+	var req struct {
+		Password        string `json:"password"`
+		CurrentPassword string `json:"currentPassword"`
+	}
+	if err := readJSON(r.Body, &req); err != nil || req.Password == "" {
+		log.Printf("ERROR: invalid password reset request: %v", err)
+		writeMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+
+	// Users changing their own password must prove that they know the current one, so that a stolen token or key
+	// cannot be turned into a password. Resetting the password of someone else is a separate, administrative action.
+	actx := getAuthContext(r.Context())
+	self := actx != nil && actx.username == user.Username
+	if !self {
+		if !s.authorize(w, r, toUserResource(*user), "RESET_PASSWORD") {
+			return
+		}
+	} else {
+		if !s.authorize(w, r, toUserResource(*user), "CHANGE_PASSWORD") {
+			return
+		}
+
+		if req.CurrentPassword == "" {
+			writeMessage(w, http.StatusBadRequest, "Current password is required")
+			return
+		}
+
+		if wait := s.retryAfter(r.Context(), s.accountAttempts, user.Username); wait > 0 {
+			writeTooManyAttempts(w, wait)
+			return
+		}
+
+		if err := bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(req.CurrentPassword)); err != nil {
+			log.Printf("ERROR: current password does not match for %s", user.Username)
+			s.recordFailure(r.Context(), s.accountAttempts, user.Username)
+			writeMessage(w, http.StatusForbidden, "Current password is incorrect")
+			return
+		}
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to reset password")
+		return
+	}
+
+	if err := s.users.UpdateUser(r.Context(), user.Username, func(u *db.UserRecord) { u.PasswordHash = hash }); err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to reset password")
+		return
+	}
+
+	s.invalidateCredentials(user.Username)
+
+	writeMessage(w, http.StatusOK, "Password reset")
+}
+
+func (s *Service) handleUserDisable(w http.ResponseWriter, r *http.Request) {
+	s.setUserDisabled(w, r, true)
+}
+
+func (s *Service) handleUserEnable(w http.ResponseWriter, r *http.Request) {
+	s.setUserDisabled(w, r, false)
+}
+
+func (s *Service) setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	defer cleanup(r)
+
+	user, err := s.retrieveUser(r)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusBadRequest, "User not found")
+		return
+	}
+
+	action, msg := "ENABLE", "User enabled"
+	if disabled {
+		action, msg = "DISABLE", "User disabled"
+	}
+
+	if !s.authorize(w, r, toUserResource(*user), action) {
+		return
+	}
+
+	if err := s.users.UpdateUser(r.Context(), user.Username, func(u *db.UserRecord) { u.Disabled = disabled }); err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to update user")
+		return
+	}
+
+	s.invalidateCredentials(user.Username)
+
+	writeMessage(w, http.StatusOK, msg)
+}
+
+func (s *Service) handleUserDelete(w http.ResponseWriter, r *http.Request) {
+	defer cleanup(r)
+
+	user, err := s.retrieveUser(r)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusBadRequest, "User not found")
+		return
+	}
+
+	if !s.authorize(w, r, toUserResource(*user), "DELETE") {
+		return
+	}
+
+	if err := s.users.DeleteUser(r.Context(), user.Username); err != nil {
+		log.Printf("ERROR: %v", err)
+		writeMessage(w, http.StatusInternalServerError, "Failed to delete user")
+		return
+	}
+
+	s.invalidateCredentials(user.Username)
+
+	if err := s.apiKeys.DeleteUserAPIKeys(r.Context(), user.Username); err != nil {
+		log.Printf("ERROR: failed to delete API keys of %s: %v", user.Username, err)
+	}
+
+	writeMessage(w, http.StatusOK, "User deleted")
+}
+
+func (s *Service) retrieveUser(r *http.Request) (*db.UserRecord, error) {
+	vars := mux.Vars(r)
+
+	return s.users.LookupUser(r.Context(), vars["username"])
+}
+
+func readJSON(r io.Reader, v any) error {
+	return json.NewDecoder(r).Decode(v)
+}
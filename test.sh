@@ -27,31 +27,139 @@ check() {
     OUT=$(mktemp)
     HTTP_CODE=$(curl --silent --output "$OUT" --write-out "%{http_code}" -u "${USER}:${USER}sStrongPassword" "$@")
 
-    cat "$OUT" && rm "$OUT"
+    cat "$OUT" && LAST_BODY=$(cat "$OUT") && rm "$OUT"
 
     if [[ "$HTTP_CODE" -ne "$EXPECTED_CODE" ]]; then
         error "Expected $EXPECTED_CODE; Got $HTTP_CODE"
     fi
 }
 
+check_header() {
+    local TITLE="$1"
+    local EXPECTED_CODE="$2"
+    local AUTH_HEADER="$3"
+    shift 3
+
+    header "$TITLE"
+
+    echo "curl -i -H '${AUTH_HEADER}' $@"
+
+    OUT=$(mktemp)
+    HTTP_CODE=$(curl --silent --output "$OUT" --write-out "%{http_code}" -H "${AUTH_HEADER}" "$@")
+
+    cat "$OUT" && LAST_BODY=$(cat "$OUT") && rm "$OUT"
+
+    if [[ "$HTTP_CODE" -ne "$EXPECTED_CODE" ]]; then
+        error "Expected $EXPECTED_CODE; Got $HTTP_CODE"
+    fi
+}
+
+# expect applies a jq filter to the body of the last response and compares the compact result with the expected value.
+expect() {
+    local FILTER="$1"
+    local EXPECTED="$2"
+
+    echo "Expecting ${FILTER} to be ${EXPECTED}"
+
+    local ACTUAL
+    ACTUAL=$(echo "$LAST_BODY" | jq -c "$FILTER")
+    if [[ "$ACTUAL" != "$EXPECTED" ]]; then
+        error "Expected ${FILTER} to be ${EXPECTED}; Got ${ACTUAL}"
+    fi
+}
+
+json_field() {
+    grep -o "\"${1}\": *\"[^\"]*\"" | cut -d '"' -f 4
+}
+
+login() {
+    curl --silent -u "${1}:${1}sStrongPassword" -XPOST "${HOST}/auth/login" | json_field token
+}
+
+mint_key() {
+    curl --silent -u "${1}:${1}sStrongPassword" -XPUT "${HOST}/admin/users/${1}/keys" -d "$2" | json_field key
+}
+
+check "Bella adds eggs to the inventory" 201 bella -XPUT "${HOST}/backoffice/inventory" -d '{"id":"eggs", "aisle":"dairy", "price":30}'
+
+check "Bella adds milk to the inventory" 201 bella -XPUT "${HOST}/backoffice/inventory" -d '{"id":"milk", "aisle":"dairy", "price":90}'
+
+check "Bella adds bread to the inventory" 201 bella -XPUT "${HOST}/backoffice/inventory" -d '{"id":"bread", "aisle":"bakery", "price":110}'
+
+check "Harry stocks up on eggs" 200 harry -XPOST "${HOST}/backoffice/inventory/eggs/replenish/100"
+
+check "Harry stocks up on milk" 200 harry -XPOST "${HOST}/backoffice/inventory/milk/replenish/10"
+
+check "Harry stocks up on bread" 200 harry -XPOST "${HOST}/backoffice/inventory/bread/replenish/10"
+
 check "Adam tries to create an order with a single item" 403 adam -XPUT "${HOST}/store/order" -d '{"items": {"eggs": 12}}'
 
 check "Adam has enough items in the order" 201 adam -XPUT "${HOST}/store/order" -d '{"items": {"eggs": 12, "milk": 1}}'
 
+check "Eve cannot order more milk than is in stock" 409 eve -XPUT "${HOST}/store/order" -d '{"items": {"eggs": 12, "milk": 20}}'
+
+check "Eve cannot order a quantity that would overflow" 400 eve -XPUT "${HOST}/store/order" -d '{"items": {"eggs": 18446744073709551615, "milk": 1}}'
+
+check "Eve cannot order zero of an item" 400 eve -XPUT "${HOST}/store/order" -d '{"items": {"eggs": 0, "milk": 1}}'
+
+check "Bella adds caviar to the inventory" 201 bella -XPUT "${HOST}/backoffice/inventory" -d '{"id":"caviar", "aisle":"deli", "price":9223372036854775807}'
+
+check "Eve cannot order items whose total would overflow" 400 eve -XPUT "${HOST}/store/order" -d '{"items": {"caviar": 3, "milk": 1}}'
+
+check "Bella removes caviar from the inventory" 200 bella -XDELETE "${HOST}/backoffice/inventory/caviar"
+
 check "Adam can view his own order" 200 adam -XGET "${HOST}/store/order/1"  
+expect '._allowedActions' '["VIEW","UPDATE","DELETE"]'
 
 check "Eve cannot view Adam's order" 403 eve -XGET "${HOST}/store/order/1"  
 
 check "Bella can view Adam's order" 200 bella -XGET "${HOST}/store/order/1"  
+expect '._allowedActions' '["VIEW","VIEW_HISTORY","UPDATE_STATUS"]'
+
+check "Bella can view an inventory item" 200 bella -XGET "${HOST}/backoffice/inventory/eggs"
+expect '._allowedActions' '["VIEW","UPDATE","DELETE","PICK","REPLENISH"]'
+
+check "Adam cannot view an inventory item" 403 adam -XGET "${HOST}/backoffice/inventory/eggs"
+
+check "Adam can list his own orders" 200 adam -XGET "${HOST}/store/order"
+expect '[.orders[].id]' '[1]'
+
+check "Eve does not see Adam's order in her list" 200 eve -XGET "${HOST}/store/order"
+expect '[.orders[].id]' '[]'
 
 check "Adam can update his pending order" 200 adam -XPOST "${HOST}/store/order/1" -d '{"items": {"eggs": 24, "milk": 1, "bread": 1}}'
 
 check "Charlie cannot set order status to PICKED because it is not in PICKING status" 403 charlie -XPOST "${HOST}/backoffice/order/1/status/PICKED" 
 
+check "Bella cannot set order status to an unknown status" 422 bella -XPOST "${HOST}/backoffice/order/1/status/BANANA"
+
+check "Bella cannot dispatch an order that has not been picked" 409 bella -XPOST "${HOST}/backoffice/order/1/status/DISPATCHED"
+
 check "Charlie can set order status to PICKING" 200 charlie -XPOST "${HOST}/backoffice/order/1/status/PICKING" 
 
+check "Adam can only view his order once it is being picked" 200 adam -XGET "${HOST}/store/order/1"
+expect '._allowedActions' '["VIEW"]'
+
+check "Bella can see who changed the status of Adam's order" 200 bella -XGET "${HOST}/store/order/1/history"
+
+check "Adam cannot view the history of his order" 403 adam -XGET "${HOST}/store/order/1/history"
+
 check "Adam cannot update his order because it is not pending" 403 adam -XPOST "${HOST}/store/order/1" -d '{"items": {"eggs": 24, "milk": 1, "bread": 1}}'
 
+check "Eve places an order" 201 eve -XPUT "${HOST}/store/order" -d '{"items": {"eggs": 6, "bread": 1}}'
+
+check "Eve only sees her own order in her list" 200 eve -XGET "${HOST}/store/order"
+expect '[.orders[].id]' '[2]'
+
+check "Bella sees every order in her list" 200 bella -XGET "${HOST}/store/order"
+expect '[.orders[].id]' '[1,2]'
+
+check "Charlie can mark a batch of orders as PICKED" 200 charlie -XPOST "${HOST}/backoffice/orders/status" -d '{"orderIDs": [1, 2, 99], "status": "PICKED"}'
+
+check "Diana can dispatch a batch of orders" 200 diana -XPOST "${HOST}/backoffice/orders/status" -d '{"orderIDs": [1, 2], "status": "DISPATCHED"}'
+
+check "Bella cannot move a batch of orders to an unknown status" 422 bella -XPOST "${HOST}/backoffice/orders/status" -d '{"orderIDs": [1], "status": "BANANA"}'
+
 check "Florence can add an item to the bakery aisle" 201 florence -XPUT "${HOST}/backoffice/inventory" -d '{"id":"white_bread", "aisle":"bakery", "price":110}'
 
 check "Florence cannot add an item to the dairy aisle" 403 florence -XPUT "${HOST}/backoffice/inventory" -d '{"id":"skimmed_milk", "aisle":"dairy", "price":120}'
@@ -64,6 +172,15 @@ check "Bella can increase the price of an item by any amount" 200 bella -XPOST "
 
 check "Harry can replenish stock" 200 harry -XPOST "${HOST}/backoffice/inventory/white_bread/replenish/10"
 
+check "Florence can search the bakery aisle" 200 florence -XGET "${HOST}/backoffice/inventory?aisle=bakery&maxPrice=500"
+expect '[.items[] | {id, aisle}]' '[{"id":"bread","aisle":"bakery"},{"id":"white_bread","aisle":"bakery"}]'
+
+check "Florence can search by price" 200 florence -XGET "${HOST}/backoffice/inventory?minPrice=50&maxPrice=150"
+expect '[.items[].id]' '["bread","milk"]'
+
+check "Adam sees no items when browsing the inventory" 200 adam -XGET "${HOST}/backoffice/inventory"
+expect '[.items[].id]' '[]'
+
 check "Harry cannot pick stock" 403 harry -XPOST "${HOST}/backoffice/inventory/white_bread/pick/1"
 
 check "Charlie can pick stock" 200 charlie -XPOST "${HOST}/backoffice/inventory/white_bread/pick/1"
@@ -72,3 +189,116 @@ check "Charlie cannot replenish stock" 403 charlie -XPOST "${HOST}/backoffice/in
 
 check "Bella can delete an item from inventory" 200 bella -XDELETE "${HOST}/backoffice/inventory/white_bread"
 
+
+check "Bella can create a new picker" 201 bella -XPUT "${HOST}/admin/users" -d '{"username":"ivan", "password":"ivansStrongPassword", "roles":["customer", "employee", "picker"]}'
+
+check "Adam cannot create users" 403 adam -XPUT "${HOST}/admin/users" -d '{"username":"mallory", "password":"mallorysStrongPassword", "roles":["manager"]}'
+
+check "Ivan can view his own account" 200 ivan -XGET "${HOST}/admin/users/ivan"
+
+check "Ivan cannot view Adam's account" 403 ivan -XGET "${HOST}/admin/users/adam"
+
+check "Ivan cannot change his password without the current one" 400 ivan -XPOST "${HOST}/admin/users/ivan/password" -d '{"password":"ivansStrongPassword"}'
+
+check "Ivan cannot change his password with the wrong current one" 403 ivan -XPOST "${HOST}/admin/users/ivan/password" -d '{"password":"ivansStrongPassword", "currentPassword":"guess"}'
+
+check "Ivan can change his password with the current one" 200 ivan -XPOST "${HOST}/admin/users/ivan/password" -d '{"password":"ivansStrongPassword", "currentPassword":"ivansStrongPassword"}'
+
+check "Ivan cannot reset Adam's password" 403 ivan -XPOST "${HOST}/admin/users/adam/password" -d '{"password":"ivansChoice"}'
+
+check "Bella can reset Ivan's password without the current one" 200 bella -XPOST "${HOST}/admin/users/ivan/password" -d '{"password":"ivansStrongPassword"}'
+
+check "Bella can assign Ivan to the bakery aisle" 200 bella -XPOST "${HOST}/admin/users/ivan" -d '{"aisles":["bakery"]}'
+
+check "Bella cannot disable her own account" 403 bella -XPOST "${HOST}/admin/users/bella/disable"
+
+check "Bella can disable Ivan's account" 200 bella -XPOST "${HOST}/admin/users/ivan/disable"
+
+check "Ivan cannot log in after being disabled" 401 ivan -XGET "${HOST}/admin/users/ivan"
+
+check "Bella can delete Ivan's account" 200 bella -XDELETE "${HOST}/admin/users/ivan"
+
+check "Bella can review the decisions made for Adam" 200 bella -XGET "${HOST}/admin/audit?user=adam&limit=5"
+
+check "Bella can review denied decisions" 200 bella -XGET "${HOST}/admin/audit?effect=DENY&resourceKind=order"
+
+check "Adam cannot review the audit log" 403 adam -XGET "${HOST}/admin/audit"
+
+ADAM_TOKEN=$(login adam)
+
+check_header "Adam can list his orders with a bearer token" 200 "Authorization: Bearer $ADAM_TOKEN" -XGET "${HOST}/store/order"
+expect '[.orders[].id]' '[1]'
+
+check_header "Adam cannot view Eve's order with a bearer token" 403 "Authorization: Bearer $ADAM_TOKEN" -XGET "${HOST}/store/order/2"
+
+check_header "Adam cannot renew his token with a bearer token" 401 "Authorization: Bearer $ADAM_TOKEN" -XPOST "${HOST}/auth/login"
+
+check_header "Adam cannot change his password with a bearer token" 403 "Authorization: Bearer $ADAM_TOKEN" -XPOST "${HOST}/admin/users/adam/password" -d '{"password":"adamsNewPassword", "currentPassword":"adamsStrongPassword"}'
+
+check_header "A forged token is rejected" 401 "Authorization: Bearer not.a.token" -XGET "${HOST}/store/order"
+
+check "Charlie cannot mint an API key with roles he does not have" 400 charlie -XPUT "${HOST}/admin/users/charlie/keys" -d '{"name":"scanner", "roles":["manager"]}'
+
+CHARLIE_KEY=$(mint_key charlie '{"name":"scanner", "roles":["employee", "picker"]}')
+CHARLIE_KEY_ID=$(echo "$CHARLIE_KEY" | sed -e 's/^drk_//' -e 's/\..*$//')
+
+check_header "Charlie's scanner can pick stock with an API key" 200 "X-API-Key: $CHARLIE_KEY" -XPOST "${HOST}/backoffice/inventory/eggs/pick/1"
+
+check_header "Charlie's scanner cannot mint more API keys" 403 "X-API-Key: $CHARLIE_KEY" -XPUT "${HOST}/admin/users/charlie/keys" -d '{"name":"another"}'
+
+check_header "Charlie's scanner cannot change Charlie's password" 403 "X-API-Key: $CHARLIE_KEY" -XPOST "${HOST}/admin/users/charlie/password" -d '{"password":"charliesNewPassword", "currentPassword":"charliesStrongPassword"}'
+
+BELLA_KEY=$(mint_key bella '{"name":"admin", "roles":["manager"]}')
+
+check_header "Bella's manager key cannot reset Adam's password" 403 "X-API-Key: $BELLA_KEY" -XPOST "${HOST}/admin/users/adam/password" -d '{"password":"adamsNewPassword"}'
+
+check_header "Bella's manager key cannot revoke Charlie's API keys" 403 "X-API-Key: $BELLA_KEY" -XDELETE "${HOST}/admin/users/charlie/keys/${CHARLIE_KEY_ID}"
+
+check_header "Bella's manager key can still list Charlie's API keys" 200 "X-API-Key: $BELLA_KEY" -XGET "${HOST}/admin/users/charlie/keys"
+
+check "Charlie can list his API keys" 200 charlie -XGET "${HOST}/admin/users/charlie/keys"
+
+check "Adam cannot list Charlie's API keys" 403 adam -XGET "${HOST}/admin/users/charlie/keys"
+
+check "Charlie can revoke his API key" 200 charlie -XDELETE "${HOST}/admin/users/charlie/keys/${CHARLIE_KEY_ID}"
+
+check_header "A revoked API key is rejected" 401 "X-API-Key: $CHARLIE_KEY" -XGET "${HOST}/backoffice/inventory/eggs"
+
+check "Bella can create a new customer" 201 bella -XPUT "${HOST}/admin/users" -d '{"username":"kate", "password":"katesStrongPassword", "roles":["customer"]}'
+
+KATE_WRONG_PASSWORD="Authorization: Basic $(printf 'kate:wrongPassword' | base64)"
+
+check_header "Kate mistypes her password" 401 "$KATE_WRONG_PASSWORD" -XGET "${HOST}/store/order"
+
+check_header "Kate mistypes her password again" 401 "$KATE_WRONG_PASSWORD" -XGET "${HOST}/store/order"
+
+check_header "Kate mistypes her password a third time" 401 "$KATE_WRONG_PASSWORD" -XGET "${HOST}/store/order"
+
+check "Kate has to wait before trying again" 429 kate -XGET "${HOST}/store/order"
+
+check "Adam cannot unlock Kate's account" 403 adam -XPOST "${HOST}/admin/users/kate/unlock"
+
+check "Bella can unlock Kate's account" 200 bella -XPOST "${HOST}/admin/users/kate/unlock"
+
+check "Kate can log in after being unlocked" 200 kate -XGET "${HOST}/store/order"
+
+check "Bella can make Kate an employee" 200 bella -XPOST "${HOST}/admin/users/kate" -d '{"roles":["customer", "employee"]}'
+
+KATE_TOKEN=$(login kate)
+
+check_header "Kate can view an inventory item with a bearer token" 200 "Authorization: Bearer $KATE_TOKEN" -XGET "${HOST}/backoffice/inventory/eggs"
+
+check "Bella can take the employee role away from Kate" 200 bella -XPOST "${HOST}/admin/users/kate" -d '{"roles":["customer"]}'
+
+check_header "Kate's token is rejected once her roles have changed" 401 "Authorization: Bearer $KATE_TOKEN" -XGET "${HOST}/backoffice/inventory/eggs"
+
+check "Adam cannot view the service metrics" 403 adam -XGET "${HOST}/admin/metrics"
+
+check "Bella can view the service metrics" 200 bella -XGET "${HOST}/admin/metrics"
+
+# The decision cache is only available when the service is started with -decisioncachettl.
+if [ "$(echo "$LAST_BODY" | jq 'has("decisionCache")')" == "true" ]; then
+    check "Adam cannot flush the decision cache" 403 adam -XDELETE "${HOST}/admin/cache/decisions"
+
+    check "Bella can flush the decision cache" 200 bella -XDELETE "${HOST}/admin/cache/decisions"
+fi